@@ -0,0 +1,7 @@
+package main
+
+import "gotools/gcp"
+
+func main() {
+	gcp.Main()
+}
@@ -0,0 +1,7 @@
+package main
+
+import gitpr "gotools/git-pr"
+
+func main() {
+	gitpr.Main()
+}
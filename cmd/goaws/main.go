@@ -0,0 +1,7 @@
+package main
+
+import "gotools/goaws"
+
+func main() {
+	goaws.Main()
+}
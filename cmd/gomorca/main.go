@@ -0,0 +1,7 @@
+package main
+
+import "gotools/gomorca"
+
+func main() {
+	gomorca.Main()
+}
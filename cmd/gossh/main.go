@@ -0,0 +1,7 @@
+package main
+
+import "gotools/gossh"
+
+func main() {
+	gossh.Main()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"gotools/util"
+)
+
+var scripts = map[string]string{
+	"bash": `_gotools() {
+	local IFS=$'\n'
+	COMPREPLY=($(gotools __complete "${COMP_WORDS[@]:1:$COMP_CWORD}"))
+}
+complete -o default -F _gotools gotools
+`,
+	"zsh": `#compdef gotools
+_gotools() {
+	local -a c
+	c=(${(f)"$(gotools __complete "${(@)words[2,CURRENT]}")"})
+	compadd -a c
+}
+compdef _gotools gotools
+`,
+	"fish": `function __gotools_complete
+	set -l args (commandline -opc) (commandline -ct)
+	gotools __complete $args[2..-1]
+end
+complete -c gotools -f -a '(__gotools_complete)'
+`,
+}
+
+func completion(shell string) {
+	s, ok := scripts[shell]
+	if !ok {
+		log.Fatalf("no completion for %s, try bash, zsh or fish", shell)
+	}
+	fmt.Print(s)
+}
+
+// complete prints the candidates for the last of the words, the command
+// line as typed so far without the program name.
+func complete(words []string) {
+	log.SetOutput(ioutil.Discard)
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+
+	print := func(c []string) {
+		sort.Strings(c)
+		for _, x := range c {
+			if strings.HasPrefix(x, cur) {
+				fmt.Println(x)
+			}
+		}
+	}
+
+	if len(words) == 1 {
+		print(append(commandNames(), "completion"))
+		return
+	}
+	if words[0] == "completion" {
+		if len(words) == 2 {
+			print([]string{"bash", "zsh", "fish"})
+		}
+		return
+	}
+
+	c, ok := commands[words[0]]
+	if !ok || c.args == nil {
+		return
+	}
+	words = words[1:]
+	if len(words) == 1 && !strings.HasPrefix(cur, "-") {
+		print(names(c.subs))
+		return
+	}
+	if len(words) > 1 {
+		if _, ok := c.subs[words[0]]; ok {
+			words = words[1:]
+		}
+	}
+
+	a := c.args()
+	flag.CommandLine.SetOutput(ioutil.Discard)
+	// no passphrase prompts or credential helpers on TAB
+	util.LoadFlagsWithoutSecrets(a, c.tool)
+
+	if strings.HasPrefix(cur, "-") {
+		dashes := "--"
+		if !strings.HasPrefix(cur, "--") {
+			dashes = "-"
+		}
+		r := []string{dashes + "show-config", dashes + "save-secrets"}
+		flag.VisitAll(func(f *flag.Flag) {
+			r = append(r, dashes+f.Name)
+		})
+		print(r)
+		return
+	}
+
+	if len(words) < 2 {
+		return
+	}
+	prev := strings.TrimLeft(words[len(words)-2], "-")
+	if prev == words[len(words)-2] || strings.Contains(prev, "=") {
+		return
+	}
+
+	// Apply the flags typed so far, they may point at another host or
+	// account than the configured one.
+	flag.CommandLine.Parse(words[:len(words)-2])
+
+	if prev == "profile" {
+		p, err := util.LoadProfiles()
+		if err == nil {
+			print(p.Names())
+		}
+		return
+	}
+	if f, ok := c.values[prev]; ok {
+		print(f(a))
+	}
+}
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == "__complete" {
+		flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	}
+}
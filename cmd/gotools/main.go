@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gotools/gcp"
+	gitpr "gotools/git-pr"
+	"gotools/goaws"
+	"gotools/gomorca"
+	"gotools/gossh"
+	"gotools/govco"
+	"gotools/jenkins"
+)
+
+type command struct {
+	help string
+	main func()
+	// config name for util.LoadFlags, empty for the tools that don't use it
+	tool string
+	args func() interface{}
+	// subcommands and the arguments they translate to
+	subs map[string][]string
+	// dynamic completion of flag values
+	values map[string]func(a interface{}) []string
+}
+
+var commands = map[string]*command{
+	"pr": {
+		help: "create and merge pull requests",
+		main: gitpr.Main,
+		tool: "pr",
+		args: func() interface{} { return &gitpr.Args{} },
+		subs: map[string][]string{
+			"create":  {"create"},
+			"merge":   {"merge"},
+			"install": {"install"},
+			"test":    {"test"},
+		},
+	},
+	"aws": {
+		help: "create EC2 instances and register them in Route53",
+		main: goaws.Main,
+		tool: "aws",
+		args: func() interface{} { return &goaws.Args{} },
+		subs: map[string][]string{
+			"create": {},
+			"dns":    {"-type=-"},
+			"delete": {"-type=none"},
+		},
+		values: map[string]func(a interface{}) []string{
+			"name": func(a interface{}) []string {
+				return goaws.Instances(a.(*goaws.Args))
+			},
+		},
+	},
+	"gcp": {
+		help: "create GCE instances and register them in Cloud DNS",
+		main: gcp.Main,
+		tool: "gcp",
+		args: func() interface{} { return &gcp.Args{} },
+		subs: map[string][]string{
+			"create": {},
+		},
+	},
+	"jenkins": {
+		help: "list jobs, start builds and download artifacts",
+		main: jenkins.Main,
+		tool: "jenkins",
+		args: func() interface{} { return jenkins.NewArgs() },
+		subs: map[string][]string{
+			"get":   {},
+			"ls":    {"-cmd=ls"},
+			"build": {"-cmd=build"},
+		},
+		values: map[string]func(a interface{}) []string{
+			"job": func(a interface{}) []string {
+				return jenkins.Jobs(a.(*jenkins.Args))
+			},
+		},
+	},
+	"vco": {
+		help: "update edge configuration over JSON-RPC",
+		main: govco.Main,
+	},
+	"ssh": {
+		help: "run a test binary on a remote host",
+		main: gossh.Main,
+	},
+	"morca": {
+		help: "generate test certificates",
+		main: gomorca.Main,
+	},
+}
+
+func names(m map[string][]string) (r []string) {
+	for n := range m {
+		r = append(r, n)
+	}
+	sort.Strings(r)
+	return
+}
+
+func commandNames() (r []string) {
+	for n := range commands {
+		r = append(r, n)
+	}
+	sort.Strings(r)
+	return
+}
+
+func usage() {
+	exe := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s COMMAND [SUBCOMMAND] [FLAGS]\n\n", exe)
+	for _, n := range commandNames() {
+		c := commands[n]
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", n, c.help)
+		if len(c.subs) > 0 {
+			fmt.Fprintf(os.Stderr, "  %-8s   %v\n", "", names(c.subs))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "  %-8s %s\n", "completion", "print the bash, zsh or fish completion script")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "completion":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		completion(os.Args[2])
+		return
+	case "__complete":
+		complete(os.Args[2:])
+		return
+	}
+
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	args := os.Args[2:]
+	if len(args) > 0 {
+		if sub, ok := c.subs[args[0]]; ok {
+			args = append(append([]string{}, sub...), args[1:]...)
+		}
+	}
+	os.Args = append([]string{os.Args[0] + " " + os.Args[1]}, args...)
+	c.main()
+}
@@ -0,0 +1,7 @@
+package main
+
+import "gotools/govco"
+
+func main() {
+	govco.Main()
+}
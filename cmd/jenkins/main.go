@@ -0,0 +1,7 @@
+package main
+
+import "gotools/jenkins"
+
+func main() {
+	jenkins.Main()
+}
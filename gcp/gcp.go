@@ -1,9 +1,10 @@
-package main
+package gcp
 
 import (
 	"bytes"
 	"context"
 	"fmt"
+	"gotools/rest"
 	"gotools/util"
 	"io/ioutil"
 	"log"
@@ -19,17 +20,17 @@ import (
 
 type Args struct {
 	Verbose      bool   `json:"verbose"`
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	Project      string `json:"project"`
-	Region       string `json:"region"`
-	Name         string `json:"name"`
-	Image        string `json:"image"`
+	ClientID     string `json:"client_id" required:"true"`
+	ClientSecret string `json:"client_secret" secret:"true" required:"true"`
+	Project      string `json:"project" help:"GCP project id" required:"true"`
+	Region       string `json:"region" help:"compute zone" required:"true"`
+	Name         string `json:"name" required:"true" pattern:"^[a-z]([-a-z0-9]*[a-z0-9])?$"`
+	Image        string `json:"image" help:"ubuntu-os-cloud image name" required:"true"`
 	Network      string `json:"network"`
 	Subnet       string `json:"subnet"`
-	Type         string `json:"type"`
-	UserData     string `json:"user_data"`
-	Zone         string `json:"zone"`
+	Type         string `json:"type" help:"machine type" required:"true"`
+	UserData     string `json:"user_data" help:"cloud-init template file"`
+	Zone         string `json:"zone" help:"Cloud DNS managed zone"`
 	SshKey       string `json:"ssh_key"`
 	service      *compute.Service
 	client       *http.Client
@@ -40,7 +41,7 @@ func wait(args *Args, op *compute.Operation, err error) {
 		log.Fatalf("%s", err)
 	}
 	service := args.service
-	log.Printf("waiting %s", op)
+	log.Printf("waiting %v", op)
 	_, err = service.ZoneOperations.Wait(args.Project, args.Region, op.Name).Do()
 
 	if err != nil {
@@ -48,11 +49,27 @@ func wait(args *Args, op *compute.Operation, err error) {
 	}
 }
 
-func updateDNS(args *Args, ip string) {
+// Instance is the result printed on stdout.
+type Instance struct {
+	Action     string   `json:"action"`
+	Name       string   `json:"name"`
+	Ip         string   `json:"ip,omitempty"`
+	PrivateIps []string `json:"private_ips"`
+	Dns        string   `json:"dns,omitempty"`
+}
+
+func updateDNS(args *Args, ip string) string {
+	if args.Zone == "" {
+		return ""
+	}
 
 	d, err := dns.New(args.client)
 
 	z, err := d.ManagedZones.Get(args.Project, args.Zone).Do()
+	if err != nil {
+		log.Printf("zone %s: %s", args.Zone, err)
+		return ""
+	}
 
 	rs := dns.ResourceRecordSet{
 		Name:    args.Name + "." + z.DnsName,
@@ -61,10 +78,20 @@ func updateDNS(args *Args, ip string) {
 		Rrdatas: []string{ip},
 	}
 
-	_, err = d.Projects.ManagedZones.Rrsets.Delete(args.Project, args.Zone, rs.Name, rs.Type).Do()
+	err = util.Mutatef(func() error {
+		_, err := d.Projects.ManagedZones.Rrsets.Delete(args.Project, args.Zone, rs.Name, rs.Type).Do()
+		return err
+	}, "delete A %s", rs.Name)
 	log.Printf("deleting %s - %s", rs.Name, err)
-	_, err = d.Projects.ManagedZones.Rrsets.Create(args.Project, args.Zone, &rs).Do()
+	err = util.Mutatef(func() error {
+		_, err := d.Projects.ManagedZones.Rrsets.Create(args.Project, args.Zone, &rs).Do()
+		return err
+	}, "create A %s %s", rs.Name, ip)
 	log.Printf("creating %s - %s", rs.Name, err)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(rs.Name, ".")
 }
 
 func create(client *http.Client, args *Args) {
@@ -76,9 +103,12 @@ func create(client *http.Client, args *Args) {
 
 	inst, err := service.Instances.Get(args.Project, args.Region, args.Name).Do()
 	if err == nil {
-		log.Printf("Cleaning up instance %s", inst)
-		op, err := service.Instances.Delete(args.Project, args.Region, args.Name).Do()
-		wait(args, op, err)
+		log.Printf("Cleaning up instance %v", inst)
+		util.Mutatef(func() error {
+			op, err := service.Instances.Delete(args.Project, args.Region, args.Name).Do()
+			wait(args, op, err)
+			return nil
+		}, "delete instance %s", args.Name)
 	}
 
 	user_data := ""
@@ -149,25 +179,37 @@ func create(client *http.Client, args *Args) {
 	}
 
 	log.Printf("crating instance %s", args.Name)
-	op, err := service.Instances.Insert(args.Project, args.Region, inst).Do()
-	wait(args, op, err)
+	util.Mutatef(func() error {
+		op, err := service.Instances.Insert(args.Project, args.Region, inst).Do()
+		wait(args, op, err)
+		return nil
+	}, "insert instance %s %s %s", args.Name, args.Type, image)
+	if util.DryRun {
+		updateDNS(args, "<new ip>")
+		return
+	}
 
 	inst, err = service.Instances.Get(args.Project, args.Region, args.Name).Do()
-	log.Printf("instance %s", inst)
+	log.Printf("instance %v", inst)
 
+	res := Instance{Action: "created", Name: inst.Name}
 	for _,intf := range inst.NetworkInterfaces {
+		res.PrivateIps = append(res.PrivateIps, intf.NetworkIP)
 		if len(intf.AccessConfigs) > 0 {
 			log.Printf("instance ip %s - %s",
 				intf.NetworkIP, intf.AccessConfigs[0].NatIP)
-			updateDNS(args, intf.AccessConfigs[0].NatIP)
+			res.Ip = intf.AccessConfigs[0].NatIP
+			res.Dns = updateDNS(args, res.Ip)
 		}
 	}
+	util.Emit(&res)
 }
 
-func main() {
+func Main() {
 	args := Args{}
 
 	util.GetFlags(&args, "gcp")
+	defer util.ShowPlan()
 
 	if args.Verbose {
 		util.Dump("args", args)
@@ -187,7 +229,7 @@ func main() {
 	}
 
 	ctx := context.Background()
-	c := newOAuthClient(ctx, config)
+	c := oauth2.NewClient(ctx, rest.NewOAuthTokenSource(ctx, config))
 	args.client = c
 	create(c, &args)
 }
@@ -1,6 +1,7 @@
-package main
+package gitpr
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/url"
@@ -8,13 +9,19 @@ import (
 	"strings"
 
 	"gotools/rest"
+	"gotools/util"
 )
 
 type BbUser struct {
-	Id   string `json:"username,omitempty"`
+	Id   string `json:"account_id,omitempty"`
+	Nick string `json:"nickname,omitempty"`
 	Name string `json:"display_name,omitempty"`
 }
 
+type BbMember struct {
+	User BbUser `json:"user"`
+}
+
 type PullRequestBody struct {
 	Source struct {
 		Branch struct {
@@ -29,12 +36,27 @@ type PullRequestBody struct {
 	Title       string   `json:"title"`
 	Description string   `json:"description"`
 	Message     string   `json:"message"`
-	Reviewers   []BbUser `json:"reviewers"`
+	Reviewers   []BbUser `json:"reviewers,omitempty"`
 	Close       bool     `json:"close_source_branch"`
 }
 
 type PullRequest struct {
-	Id    int `json:"id,omitempty"`
+	Id     int    `json:"id,omitempty"`
+	Title  string `json:"title,omitempty"`
+	State  string `json:"state,omitempty"`
+	Source struct {
+		Branch struct {
+			Name string `json:"name,omitempty"`
+		} `json:"branch,omitempty"`
+		Commit struct {
+			Hash string `json:"hash,omitempty"`
+		} `json:"commit,omitempty"`
+	} `json:"source,omitempty"`
+	Destination struct {
+		Branch struct {
+			Name string `json:"name,omitempty"`
+		} `json:"branch,omitempty"`
+	} `json:"destination,omitempty"`
 	Links struct {
 		Html struct {
 			Href string `json:"href,omitempty"`
@@ -42,27 +64,46 @@ type PullRequest struct {
 	} `json:"links,omitempty"`
 }
 
+func (pr *PullRequest) result() *Result {
+	return &Result{
+		Id:     pr.Id,
+		Url:    pr.Links.Html.Href,
+		State:  pr.State,
+		Source: pr.Source.Branch.Name,
+		Target: pr.Destination.Branch.Name,
+		Title:  pr.Title,
+	}
+}
+
 type PullRequestMerge struct {
 	Strategy string `json:"merge_strategy"`
+	Close    bool   `json:"close_source_branch"`
+	Message  string `json:"message,omitempty"`
+}
+
+// the merge strategies of Bitbucket Cloud for --method
+var bbStrategies = map[string]string{
+	"merge":  "merge_commit",
+	"squash": "squash",
+	"rebase": "rebase_merge",
 }
 
-func (b *Bb) members(r *rest.Rest, args *Args) (users []User) {
+// members lists the workspace, --team, reviewers are given by account id.
+func (b *Bb) members(ctx context.Context, r *rest.Rest, args *Args) (users []User) {
 
 	if args.Team == "" {
 		return
 	}
 
-	resp, err := r.Get(fmt.Sprintf("/teams/%s/members", args.Team), nil, nil)
+	bbusers := []BbMember{}
+	err := r.List(ctx, fmt.Sprintf("/workspaces/%s/members", args.Team), nil).All(&bbusers)
 	if err != nil {
-		log.Panic(err)
+		log.Fatalf("members of %s: %s", args.Team, err)
 	}
 
-	bbusers := []BbUser{}
-	unpack(resp, &bbusers)
-
 	for _, u := range bbusers {
-		if u.Id != args.User {
-			users = append(users, User{Id: u.Id, Name: u.Name})
+		if u.User.Nick != args.User {
+			users = append(users, User{Id: u.User.Id, Name: u.User.Name})
 		}
 	}
 
@@ -70,13 +111,14 @@ func (b *Bb) members(r *rest.Rest, args *Args) (users []User) {
 
 }
 
-func (b *Bb) create() {
+func (b *Bb) create(ctx context.Context) {
 
 	args := b.args
-	r := rest.NewRest("https://api.bitbucket.org/2.0",
-		args.User, args.Password, args.Verbose)
+	r := b.r
 
-	users := b.members(r, args)
+	mctx, cancel := args.deadline(ctx)
+	users := b.members(mctx, r, args)
+	cancel()
 
 	fn := prepare(args, users)
 	defer os.Remove(fn)
@@ -92,65 +134,99 @@ func (b *Bb) create() {
 		body := PullRequestBody{
 			Title:       subj,
 			Description: desc,
+			Close:       args.Remove,
 		}
 		for _, u := range users {
-			body.Reviewers = append(body.Reviewers, BbUser{Id: u.Id, Name: u.Name})
+			body.Reviewers = append(body.Reviewers, BbUser{Id: u.Id})
 		}
 		body.Source.Branch.Name = args.Branch
 		body.Destination.Branch.Name = args.Upstream
 
 		path := fmt.Sprintf("/repositories/%s/%s/pullrequests", args.Owner, args.Repo)
-		res, err := r.Post(path, body)
+		prr := PullRequest{}
+		actx, cancel := args.deadline(ctx)
+		err := r.Call(actx, "POST", path, nil, body, &prr)
 		if err != nil {
-			log.Print(err)
+			giveUp(actx, err, fn)
+			cancel()
 			continue
 		}
+		cancel()
 
-		prr := PullRequest{}
-		unpack(res, &prr)
-		dump("Pull request", prr)
+		util.Emit(prr.result())
 		break
 	}
 
 }
 
-func (b *Bb) merge() {
+func (b *Bb) merge(ctx context.Context) {
+	// the state of the pull request, not --max_age old
+	ctx = rest.Revalidate(ctx)
 	args := b.args
+	r := b.r
 
-	rest := rest.NewRest("https://api.bitbucket.org/2.0",
-		args.User, args.Password, args.Verbose)
-
-	query := fmt.Sprintf("state=\"OPEN\" AND author.username=\"%s\" AND source.branch.name=\"%s\"",
-		args.User, args.Branch)
-	resp, err := rest.Get(fmt.Sprintf("/repositories/%s/%s/pullrequests", args.Owner, args.Repo),
+	query := fmt.Sprintf("state=\"OPEN\" AND source.branch.name=\"%s\" AND destination.branch.name=\"%s\"",
+		args.Branch, args.Upstream)
+	prs := []PullRequest{}
+	err := r.List(ctx, fmt.Sprintf("/repositories/%s/%s/pullrequests", args.Owner, args.Repo),
 		url.Values{
 			"q": []string{query},
-		}, nil)
+		}).Max(2).All(&prs)
 
 	if err != nil {
-		log.Panic(err)
+		log.Fatal(err)
 	}
-	prs := []PullRequest{}
-	unpack(resp, &prs)
-	dump("Resp:", prs)
-
-	m := PullRequestMerge{Strategy: "merge_commit"}
-	for _, pr := range prs {
-		url := fmt.Sprintf("/repositories/%s/%s/pullrequests/%d/merge",
-			args.Owner, args.Repo, pr.Id)
-		rest.Post(url, m)
+	if args.Verbose {
+		dump("prs", prs)
+	}
+	switch len(prs) {
+	case 0:
+		log.Fatalf("no open pull request for %s into %s", args.Branch, args.Upstream)
+	case 1:
+	default:
+		log.Fatalf("more than one open pull request for %s into %s", args.Branch, args.Upstream)
+	}
+	pr := prs[0]
+	atHead(ctx, pr.Links.Html.Href, pr.Source.Commit.Hash)
+
+	m := PullRequestMerge{Strategy: bbStrategies[args.Method], Close: args.Remove,
+		Message: args.Message}
+	path := fmt.Sprintf("/repositories/%s/%s/pullrequests/%d/merge",
+		args.Owner, args.Repo, pr.Id)
+	if err := r.Call(ctx, "POST", path, nil, m, &pr); err != nil {
+		log.Fatalf("merging %d: %s", pr.Id, err)
 	}
+	util.Emit(pr.result())
 }
 
-func (b *Bb) test() {
+func (b *Bb) test(ctx context.Context) {
+	var x interface{}
+	if err := b.r.Call(ctx, "GET", b.args.testPath(), nil, nil, &x); err != nil {
+		log.Fatal(err)
+	}
+	util.Emit(x)
 }
 
 type Bb struct {
 	args *Args
+	r    *rest.Rest
 }
 
-func bb(args *Args) Git {
+// NewBitbucket returns the Bitbucket Cloud backend, or the Server/Data
+// Center one when --api-url points elsewhere.
+func NewBitbucket(args *Args) Git {
+	url := args.ApiUrl
+	if url == "" {
+		url = "https://api.bitbucket.org/2.0"
+	}
+	if !strings.Contains(url, "api.bitbucket.org") {
+		return NewBbServer(args, url)
+	}
+	r := newRest(args, url,
+		&rest.BasicAuth{User: args.User, Password: args.Password})
+	r.Paginator = rest.Cursor{Items: "values", Next: "next"}
 	return &Bb{
 		args: args,
+		r:    r,
 	}
 }
@@ -0,0 +1,279 @@
+package gitpr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gotools/rest"
+	"gotools/util"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// BbServer is Bitbucket Server/Data Center, Owner is the project key.
+type BbServer struct {
+	args *Args
+	r    *rest.Rest
+	url  string
+}
+
+func NewBbServer(args *Args, url string) Git {
+	b := BbServer{}
+	b.args = args
+	b.url = strings.TrimRight(url, "/")
+	var auth rest.Authenticator = rest.BearerToken(args.Password)
+	// the user defaults to the local login, only one that is set asks
+	// for basic auth
+	if o := util.OriginOf("user"); args.User != "" && o.Layer != util.FromDefault {
+		auth = &rest.BasicAuth{User: args.User, Password: args.Password}
+	}
+	b.r = newRest(args, b.url, auth)
+	b.r.Paginator = rest.Cursor{Items: "values", Next: "nextPageStart", Param: "start"}
+	return &b
+}
+
+func (b *BbServer) test(ctx context.Context) {
+	var x interface{}
+	if err := b.r.Call(ctx, "GET", b.args.testPath(), nil, nil, &x); err != nil {
+		log.Fatal(err)
+	}
+	util.Emit(x)
+}
+
+type BbsUser struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+	Active      bool   `json:"active,omitempty"`
+}
+
+type BbsReviewer struct {
+	User BbsUser `json:"user"`
+}
+
+type BbsRef struct {
+	Id           string `json:"id"`
+	DisplayId    string `json:"displayId,omitempty"`
+	LatestCommit string `json:"latestCommit,omitempty"`
+	Repository   struct {
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+	} `json:"repository"`
+}
+
+type BbsPullRequest struct {
+	Id          int           `json:"id,omitempty"`
+	Version     int           `json:"version,omitempty"`
+	Title       string        `json:"title"`
+	Description string        `json:"description,omitempty"`
+	State       string        `json:"state,omitempty"`
+	FromRef     BbsRef        `json:"fromRef"`
+	ToRef       BbsRef        `json:"toRef"`
+	Reviewers   []BbsReviewer `json:"reviewers,omitempty"`
+	Links       struct {
+		Self []struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links,omitempty"`
+}
+
+func (pr *BbsPullRequest) result() *Result {
+	r := &Result{
+		Id:     pr.Id,
+		State:  strings.ToLower(pr.State),
+		Source: pr.FromRef.DisplayId,
+		Target: pr.ToRef.DisplayId,
+		Title:  pr.Title,
+	}
+	if len(pr.Links.Self) > 0 {
+		r.Url = pr.Links.Self[0].Href
+	}
+	return r
+}
+
+// BbsMergeStatus says whether the pull request can be merged, the vetoes
+// are the unmet merge checks.
+type BbsMergeStatus struct {
+	CanMerge   bool `json:"canMerge"`
+	Conflicted bool `json:"conflicted"`
+	Vetoes     []struct {
+		Summary string `json:"summaryMessage"`
+		Detail  string `json:"detailedMessage"`
+	} `json:"vetoes"`
+}
+
+type BbsMerge struct {
+	Strategy string `json:"strategyId,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// the merge strategies of Bitbucket Server for --method
+var bbsStrategies = map[string]string{
+	"merge":  "no-ff",
+	"squash": "squash",
+	"rebase": "rebase-no-ff",
+}
+
+func (b *BbServer) repo() string {
+	return fmt.Sprintf("/projects/%s/repos/%s", b.args.Owner, b.args.Repo)
+}
+
+func (b *BbServer) ref(branch string) BbsRef {
+	r := BbsRef{Id: "refs/heads/" + branch}
+	r.Repository.Slug = b.args.Repo
+	r.Repository.Project.Key = b.args.Owner
+	return r
+}
+
+// members lists the group --team.
+func (b *BbServer) members(ctx context.Context) (users []User) {
+	args := b.args
+	if args.Team == "" {
+		return
+	}
+	bbusers := []BbsUser{}
+	query := url.Values{"context": []string{args.Team}}
+	// an admin API, other users get a 401 and no suggested reviewers
+	err := b.r.List(ctx, "/admin/groups/more-members", query).All(&bbusers)
+	if err != nil {
+		log.Printf("members of %s: %s", args.Team, err)
+		return nil
+	}
+	for _, u := range bbusers {
+		if u.Name != args.User && u.Active {
+			users = append(users, User{Id: u.Name, Name: u.DisplayName})
+		}
+	}
+	return
+}
+
+func (b *BbServer) create(ctx context.Context) {
+	args := b.args
+	mctx, cancel := args.deadline(ctx)
+	fn := prepare(args, b.members(mctx))
+	cancel()
+	defer os.Remove(fn)
+
+	for {
+		subj, desc := edit(fn)
+		meta, desc := trailers(desc)
+		if strings.HasPrefix(subj, "!") {
+			return
+		}
+
+		body := BbsPullRequest{
+			Title:       subj,
+			Description: desc,
+			FromRef:     b.ref(args.Branch),
+			ToRef:       b.ref(args.Upstream),
+		}
+		for _, u := range reviewers(meta) {
+			body.Reviewers = append(body.Reviewers, BbsReviewer{User: BbsUser{Name: u.Id}})
+		}
+
+		pr := BbsPullRequest{}
+		actx, cancel := args.deadline(ctx)
+		err := b.r.Call(actx, "POST", b.repo()+"/pull-requests", nil, &body, &pr)
+		if err == nil {
+			cancel()
+			util.Emit(pr.result())
+			break
+		}
+		// DuplicatePullRequestException
+		var aerr *rest.APIError
+		if errors.As(err, &aerr) && aerr.StatusCode == http.StatusConflict {
+			pr, lerr := b.pr(actx)
+			if lerr == nil {
+				cancel()
+				log.Print(aerr)
+				util.Emit(pr.result())
+				return
+			}
+			log.Print(lerr)
+		}
+		giveUp(actx, err, fn)
+		cancel()
+	}
+}
+
+// pr returns the open pull request of the branch, an error when there is
+// none or more than one.
+func (b *BbServer) pr(ctx context.Context) (*BbsPullRequest, error) {
+	ctx = rest.Revalidate(ctx)
+	args := b.args
+	query := url.Values{
+		"state":     []string{"OPEN"},
+		"direction": []string{"OUTGOING"},
+		"at":        []string{"refs/heads/" + args.Branch},
+	}
+	prs := []BbsPullRequest{}
+	if err := b.r.List(ctx, b.repo()+"/pull-requests", query).All(&prs); err != nil {
+		return nil, err
+	}
+	found := []BbsPullRequest{}
+	for _, pr := range prs {
+		if pr.ToRef.DisplayId == args.Upstream {
+			found = append(found, pr)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no open pull request for %s into %s",
+			args.Branch, args.Upstream)
+	case 1:
+		return &found[0], nil
+	}
+	return nil, fmt.Errorf("more than one open pull request for %s into %s",
+		args.Branch, args.Upstream)
+}
+
+func (b *BbServer) merge(ctx context.Context) {
+	// the state of the pull request, not --max_age old
+	ctx = rest.Revalidate(ctx)
+	args := b.args
+	pr, err := b.pr(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	atHead(ctx, pr.result().Url, pr.FromRef.LatestCommit)
+	path := fmt.Sprintf("%s/pull-requests/%d/merge", b.repo(), pr.Id)
+
+	st := BbsMergeStatus{}
+	if err := b.r.Call(ctx, "GET", path, nil, nil, &st); err != nil {
+		log.Fatal(err)
+	}
+	if !st.CanMerge {
+		msgs := []string{}
+		if st.Conflicted {
+			msgs = append(msgs, "conflicts with "+args.Upstream)
+		}
+		for _, v := range st.Vetoes {
+			msgs = append(msgs, v.Summary+": "+v.Detail)
+		}
+		log.Fatalf("%s can't be merged: %s", pr.result().Url, strings.Join(msgs, "; "))
+	}
+
+	query := url.Values{"version": []string{fmt.Sprint(pr.Version)}}
+	m := BbsMerge{Strategy: bbsStrategies[args.Method], Message: args.Message}
+	if err := b.r.Call(ctx, "POST", path, query, &m, pr); err != nil {
+		log.Fatal(err)
+	}
+
+	if args.Remove {
+		// the branch utils live next to the core API
+		root := strings.TrimSuffix(b.url, "/rest/api/1.0")
+		del := struct {
+			Name string `json:"name"`
+		}{"refs/heads/" + args.Branch}
+		path := fmt.Sprintf("%s/rest/branch-utils/1.0/projects/%s/repos/%s/branches",
+			root, args.Owner, args.Repo)
+		if err := b.r.Call(ctx, "DELETE", path, nil, &del, nil); err != nil {
+			log.Printf("removing %s: %s", args.Branch, err)
+		}
+	}
+	util.Emit(pr.result())
+}
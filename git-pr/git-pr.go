@@ -1,34 +1,64 @@
-package main
+package gitpr
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"gotools/rest"
 	"gotools/util"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type Args struct {
-	Git      string `json:"git,omitempty"`
-	Owner    string `json:"owner,omitempty"`
-	Repo     string `json:"repo,omitempty"`
-	User     string `json:"user,omitempty"`
-	Password string `json:"password,omitempty"`
-	Branch   string `json:"branch,omitempty"`
-	Upstream string `json:"upstream,omitempty"`
-	Team     string `json:"team,omitempty"`
+	Git      string            `json:"git,omitempty" help:"provider, detected from the remote when empty" oneof:"github gitlab bitbucket"`
+	ApiUrl   string            `json:"api-url,omitempty" help:"API url, derived from the remote when empty"`
+	Hosts    map[string]string `json:"hosts,omitempty" help:"providers of self-hosted instances, host=github|gitlab|bitbucket"`
+	Owner    string            `json:"owner,omitempty" help:"owner or group/subgroup, detected from the upstream remote" required:"true"`
+	Repo     string            `json:"repo,omitempty" help:"repository, detected from the upstream remote" required:"true"`
+	User     string            `json:"user,omitempty"`
+	Password string            `json:"password,omitempty" secret:"true" help:"API token" required:"app.id=0"`
+	App      struct {
+		Id           int64  `json:"id,omitempty" help:"GitHub app id, authenticate as the app instead of with --password" requires:"app.installation app.key"`
+		Installation int64  `json:"installation,omitempty" help:"GitHub app installation id"`
+		Key          string `json:"key,omitempty" help:"GitHub app private key PEM file"`
+	} `json:"app"`
+	Branch   string `json:"branch,omitempty" help:"source branch, the current one when empty" required:"true"`
+	Upstream string `json:"upstream,omitempty" help:"target branch, the upstream of the current one when empty" required:"true"`
+	Team     string `json:"team,omitempty" help:"group to pick reviewers from"`
 	Label    string `json:"label,omitempty"`
-	Remove   bool   `json:"remove,omitempty"`
+	Remove   bool   `json:"remove,omitempty" help:"remove source branch on merge"`
+	Method   string `json:"method,omitempty" help:"merge method" oneof:"merge squash rebase"`
+	Message  string `json:"message,omitempty" help:"merge commit message"`
 	Verbose  bool   `json:"verbose"`
-	remote   string
-	args     []string
+
+	Retries        int           `json:"retries" help:"retries of failed API requests, rate limit resets are waited for anyway"`
+	Timeout        time.Duration `json:"timeout" help:"give up on each phase of API calls after this long: the push, the lookups before editing, each submission, the merge"`
+	RequestTimeout time.Duration `json:"request_timeout" help:"timeout of each API request"`
+	Tls            rest.TLS      `json:"tls"`
+	Record         string        `json:"record" help:"save the API requests and responses to this cassette file"`
+	Replay         string        `json:"replay" help:"serve the API responses from this cassette file, offline"`
+	Cache          bool          `json:"cache" help:"keep the API responses on disk and revalidate them"`
+	MaxAge         time.Duration `json:"max_age" help:"use cached responses younger than this without revalidating, the state of pull requests is always revalidated" requires:"cache"`
+	Trace          string        `json:"trace" help:"save the API request and response bodies to this directory"`
+	Curl           bool          `json:"curl" help:"print a curl command reproducing each failed API request"`
+
+	WhenPipelineSucceeds bool `json:"when_pipeline_succeeds,omitempty" help:"let GitLab merge once the pipeline succeeds"`
+
+	remote string
+	host   string
+	path   string
+	args   []string
 }
 
 type User struct {
@@ -37,26 +67,70 @@ type User struct {
 }
 
 type Git interface {
-	create()
-	merge()
-	test()
+	create(ctx context.Context)
+	merge(ctx context.Context)
+	test(ctx context.Context)
 }
 
-func dump(prefix string, v interface{}) {
-	b, _ := json.MarshalIndent(v, "", "  ")
+// Result is what the create and merge commands print on stdout.
+type Result struct {
+	Id     int    `json:"id"`
+	Url    string `json:"url"`
+	State  string `json:"state"`
+	Source string `json:"source_branch"`
+	Target string `json:"target_branch"`
+	Title  string `json:"title,omitempty"`
+}
 
-	fmt.Printf("%s: %s\n", prefix, b)
+func (r *Result) String() string {
+	return fmt.Sprintf("%s %s", r.State, r.Url)
 }
 
-func unpack(src, dst interface{}) {
-	b, err := json.Marshal(src)
-	if err != nil {
-		log.Panic(err)
+func newRest(args *Args, url string, auth rest.Authenticator) *rest.Rest {
+	r := rest.NewRest(url, auth, args.Verbose)
+	r.Retry.Max = args.Retries
+	r.Timeout = args.RequestTimeout
+	if args.Trace != "" || args.Curl {
+		r.Trace = &rest.Trace{Log: args.Verbose, Bodies: args.Trace, Curl: args.Curl}
 	}
-	err = json.Unmarshal(b, dst)
-	if err != nil {
-		log.Panic(err)
+	if args.Tls.CA != "" || args.Tls.Cert != "" {
+		tr, err := rest.NewTransport(&args.Tls)
+		if err != nil {
+			log.Fatalf("tls: %s", err)
+		}
+		r.Client = &http.Client{Transport: tr}
+	}
+	if args.Cache {
+		r.Client = &http.Client{
+			Transport: rest.NewCache("", args.MaxAge, r.Client.Transport),
+		}
+	}
+	if args.Record != "" || args.Replay != "" {
+		file := args.Record
+		if args.Replay != "" {
+			file = args.Replay
+		}
+		rec, err := rest.NewRecorder(file, args.Replay != "", r.Client.Transport)
+		if err != nil {
+			log.Fatalf("cassette: %s", err)
+		}
+		r.Client = &http.Client{Transport: rec}
+	}
+	return r
+}
+
+// id is n in a path, <new> for what a dry run only pretends to create.
+func id(n int) string {
+	if n == 0 && util.DryRun {
+		return "<new>"
 	}
+	return strconv.Itoa(n)
+}
+
+func dump(prefix string, v interface{}) {
+	b, _ := json.MarshalIndent(v, "", "  ")
+
+	fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, b)
 }
 
 func strip(s string) string {
@@ -134,10 +208,9 @@ var requestBody = `#
 Notify @{{.Args.Team}}
 
 ####### trailers ##########
-Gitlab-Label: {{ .Args.Label }}
-# This PR will trigger the following test
-Jenkins-Suite: {{.Args.JenkinsSuite}}
-
+{{if eq .Args.Git "github"}}Github-Label: {{ .Args.Label }}
+{{else if eq .Args.Git "gitlab"}}Gitlab-Label: {{ .Args.Label }}
+{{end}}
 # This PR will add the following users to approvers
 {{range .Members }}#Review-By: {{ .Id }} <{{ .Name }}>
 {{end}}
@@ -165,7 +238,14 @@ func expand(args *Args, body, text string) string {
 
 func prepare(args *Args, m []User) (fn string) {
 
-	text := util.Sh(`git`, `log`, `--reverse`, `@{u}..`, `--pretty= - %B`)
+	text, err := util.Run(context.Background(),
+		`git`, `log`, `--reverse`, `@{u}..`, `--pretty= - %B`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(text) < 2 {
+		log.Fatalf("no commits to submit on top of %s", args.Upstream)
+	}
 	text = text[2:]
 
 	t, err := template.New("PR").Parse(requestBody)
@@ -188,9 +268,57 @@ func prepare(args *Args, m []User) (fn string) {
 
 	err = t.Execute(f, data)
 	f.Close()
+	if err != nil {
+		log.Panic(err)
+	}
 	return
 }
 
+// testPath is the path that test gets, relative to the API url with or
+// without the leading slash, or a full url.
+func (args *Args) testPath() string {
+	if len(args.args) == 0 {
+		log.Fatal("usage: git pr test <path>")
+	}
+	p := args.args[0]
+	if !strings.HasPrefix(p, "/") && !strings.Contains(p, "://") {
+		p = "/" + p
+	}
+	return p
+}
+
+// atHead stops a merge unless sha, the source branch of the pull request
+// at url, is the local HEAD. Bitbucket Cloud gives abbreviated hashes.
+func atHead(ctx context.Context, url, sha string) {
+	head, err := util.Run(ctx, `git`, `rev-parse`, `HEAD`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sha == "" || !strings.HasPrefix(head, sha) {
+		log.Fatalf("%s: the source branch is at %.12s, not at HEAD %.12s, push first",
+			url, sha, head)
+	}
+}
+
+// deadline bounds one phase of the API calls of a command with --timeout,
+// it is not a budget of the whole command. create starts one for the push,
+// one before editing and one for each submission, so the editor and the
+// retries after a failure don't count against it.
+func (args *Args) deadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if args.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, args.Timeout)
+}
+
+// giveUp ends create once ctx is done, the description is left in fn.
+func giveUp(ctx context.Context, err error, fn string) {
+	if ctx.Err() != nil {
+		log.Fatalf("%s, the description is kept in %s", err, fn)
+	}
+	log.Print(err)
+}
+
 func edit(fn string) (subj, desc string) {
 	editor, ok := os.LookupEnv("GIT_EDITOR")
 	if !ok {
@@ -216,42 +344,97 @@ func edit(fn string) (subj, desc string) {
 
 func install(args Args) {
 	exe := os.Args[0]
-	util.Sh(`git`, `config`, `--global`, `alias.pr`, `!`+exe)
+	if err := util.GitConfig(`alias.pr`, `!`+exe); err != nil {
+		log.Fatal(err)
+	}
 	util.SaveGitFlags("pr")
 }
 
-func git_detect(args *Args) {
-
-	upstream := strings.SplitN(
-		util.Sh(`git`, `rev-parse`, `--abbrev-ref`, `@{u}`), "/", 2)
+func git_detect(ctx context.Context, args *Args) error {
 
-	remote := strings.Split(
-		util.Sh(`git`, `remote`, `get-url`, upstream[0]), ":")
+	u, err := util.Run(ctx, `git`, `rev-parse`, `--abbrev-ref`, `@{u}`)
+	if err != nil {
+		return fmt.Errorf("no upstream branch, set one with "+
+			"'git branch -u <remote>/<branch>': %w", err)
+	}
+	upstream := strings.SplitN(u, "/", 2)
+	if len(upstream) != 2 {
+		return fmt.Errorf("upstream %q is not a remote branch", u)
+	}
 
-	repo := strings.SplitN(remote[len(remote)-1], "/", 2)
+	r, err := util.Run(ctx, `git`, `remote`, `get-url`, upstream[0])
+	if err != nil {
+		return err
+	}
+	remote, err := parseRemote(r)
+	if err != nil {
+		return err
+	}
 
 	args.remote = upstream[0]
+	args.host = remote.Host
+	args.path = remote.Path
 	args.Upstream = upstream[1]
-	args.Owner = repo[0]
-	args.Repo = strings.TrimSuffix(repo[1], ".git")
+	args.Owner = remote.Namespace
+	args.Repo = remote.Repo
 
-	args.Branch = util.Sh(`git`, `symbolic-ref`, `--short`, `HEAD`)
+	args.Branch, err = util.Run(ctx, `git`, `symbolic-ref`, `--short`, `HEAD`)
+	return err
 }
 
-func main() {
+func push(ctx context.Context, args *Args) {
+	push := []string{`push`, `-f`, args.remote, fmt.Sprintf("HEAD:%s", args.Branch)}
+	err := util.Mutate("git "+strings.Join(push, " "), func() error {
+		_, err := util.Exec.Run(ctx, &util.Cmd{
+			Name:   `git`,
+			Args:   push,
+			Stderr: os.Stderr,
+		})
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func Main() {
 	args := Args{
-		Branch: "{{.Branch}}",
+		Method:  "merge",
+		Retries: rest.DefaultRetry.Max,
 	}
 
-	git_detect(&args)
+	// the defaults, the flags or the validation tell what is missing
+	if err := git_detect(context.Background(), &args); err != nil {
+		log.Printf("warning: %s", err)
+	}
 
 	util.GetFlags(&args, "pr")
+	defer util.ShowPlan()
+	ctx, cancel := util.Interruptible(0)
+	defer cancel()
 	if len(flag.Args()) > 0 {
 		args.args = flag.Args()[1:]
 	}
+	if flag.Arg(0) == "install" {
+		install(args)
+		return
+	}
+	if args.Git == "" {
+		args.Git = provider(args.host, args.Hosts)
+	}
+	if args.ApiUrl == "" {
+		args.ApiUrl = apiUrl(args.Git, args.host, args.path)
+	}
 
 	if args.Verbose {
-		dump("args:", &args)
+		a := args
+		if a.Password != "" {
+			a.Password = "********"
+		}
+		if strings.Contains(a.App.Key, "PRIVATE KEY") {
+			a.App.Key = "********"
+		}
+		dump("args:", &a)
 	}
 
 	var git Git
@@ -260,20 +443,30 @@ func main() {
 		git = NewGithub(&args)
 	case "gitlab":
 		git = NewGitlab(&args)
+	case "bitbucket":
+		git = NewBitbucket(&args)
+	default:
+		log.Fatalf("can't tell the provider of %q, set --git or --hosts %s=github|gitlab|bitbucket",
+			args.host, args.host)
 	}
 
+	tctx, tcancel := args.deadline(ctx)
+	defer tcancel()
 	switch flag.Arg(0) {
-	case "install":
-		install(args)
 	case "merge":
-		git.merge()
+		git.merge(tctx)
 	case "test":
-		git.test()
+		git.test(tctx)
 	case "", "create":
-		util.Sh(`git`, `push`, `-f`, args.remote, fmt.Sprintf("HEAD:%s", args.Branch))
-		git.create()
+		// offline, the recorded flow pushed already
+		if args.Replay == "" {
+			push(tctx, &args)
+		}
+		// it starts the deadlines of its own around the editor
+		git.create(ctx)
 	default:
-		log.Panic(flag.Args())
+		flag.Usage()
+		log.Fatalf("unknown command %q", flag.Arg(0))
 	}
 
 }
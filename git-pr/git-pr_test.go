@@ -0,0 +1,68 @@
+package gitpr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"gotools/util"
+)
+
+func fakeGit(t *testing.T, results map[string]util.FakeResult) *util.FakeExecutor {
+	x := &util.FakeExecutor{Results: results}
+	saved := util.Exec
+	util.Exec = x
+	t.Cleanup(func() { util.Exec = saved })
+	return x
+}
+
+func TestGitDetect(t *testing.T) {
+	fakeGit(t, map[string]util.FakeResult{
+		"git rev-parse --abbrev-ref @{u}": {Out: "origin/release/3.2\n"},
+		"git remote get-url origin":       {Out: "git@gitlab.com:group/sub/repo.git\n"},
+		"git symbolic-ref --short HEAD":   {Out: "my-fix\n"},
+	})
+
+	args := Args{}
+	if err := git_detect(context.Background(), &args); err != nil {
+		t.Fatal(err)
+	}
+	want := Args{
+		Owner:    "group/sub",
+		Repo:     "repo",
+		Branch:   "my-fix",
+		Upstream: "release/3.2",
+		remote:   "origin",
+		host:     "gitlab.com",
+	}
+	if args.Owner != want.Owner || args.Repo != want.Repo ||
+		args.Branch != want.Branch || args.Upstream != want.Upstream ||
+		args.remote != want.remote || args.host != want.host {
+		t.Errorf("got %+v, want %+v", args, want)
+	}
+}
+
+func TestGitDetectNoUpstream(t *testing.T) {
+	x := fakeGit(t, map[string]util.FakeResult{
+		"git rev-parse --abbrev-ref @{u}": {
+			ExitCode: 128,
+			Stderr:   "fatal: no upstream configured for branch 'my-fix'\n",
+		},
+	})
+
+	err := git_detect(context.Background(), &Args{})
+	if err == nil {
+		t.Fatal("no error without an upstream")
+	}
+	var eerr *util.ExecError
+	if !errors.As(err, &eerr) || eerr.ExitCode != 128 {
+		t.Errorf("error %v does not wrap the git failure", err)
+	}
+	if !strings.Contains(err.Error(), "git branch -u") {
+		t.Errorf("error %q does not say how to set the upstream", err)
+	}
+	if len(x.Calls) != 1 {
+		t.Errorf("ran %q after the failure", x.Calls)
+	}
+}
@@ -1,11 +1,22 @@
-package main
+package gitpr
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"gotools/rest"
+	"gotools/util"
 	"log"
+	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
+// how often merge polls the checks of the pull request
+var checkInterval = 30 * time.Second
+
 type Github struct {
 	args *Args
 	r    *rest.Rest
@@ -15,48 +26,307 @@ type Github struct {
 func NewGithub(args *Args) Git {
 	g := Github{}
 	g.args = args
-	g.url = "https://api.github.com"
-	g.r = rest.NewRest(g.url,
-		args.User, args.Password, args.Verbose)
+	g.url = strings.TrimRight(args.ApiUrl, "/")
+	var auth rest.Authenticator = rest.BearerToken(args.Password)
+	var app *rest.GithubApp
+	if args.App.Id != 0 {
+		var err error
+		app, err = rest.NewGithubApp(g.url, args.App.Id,
+			args.App.Installation, args.App.Key)
+		if err != nil {
+			log.Fatalf("github app: %s", err)
+		}
+		auth = app
+	}
+	g.r = newRest(args, g.url, auth)
+	if app != nil {
+		// the tokens go through the same transport, cassette and trace
+		app.Rest = g.r
+	}
 	return &g
 }
 
-func (g *Github) request(method, path string, data interface{}) ([]map[string]interface{}, error) {
-	x, err := g.r.Do(method, g.url+path, nil, data)
-	return x, err
+func (g *Github) test(ctx context.Context) {
+	var x interface{}
+	if err := g.r.Call(ctx, "GET", g.args.testPath(), nil, nil, &x); err != nil {
+		log.Fatal(err)
+	}
+	util.Emit(x)
 }
 
-func (g *Github) Get(path string) []map[string]interface{} {
-	x, err := g.request("GET", path, nil)
-	if err != nil {
-		log.Panic(err)
+type GithubUser struct {
+	Login string `json:"login"`
+}
+
+// members lists the team, given as org/team or just team of the owner.
+func (g *Github) members(ctx context.Context) (users []User) {
+	args := g.args
+	if args.Team == "" {
+		return
 	}
-	return x
+	org, team := args.Owner, args.Team
+	if i := strings.LastIndex(team, "/"); i >= 0 {
+		org, team = team[:i], team[i+1:]
+	}
+
+	ghusers := []GithubUser{}
+	path := fmt.Sprintf("/orgs/%s/teams/%s/members", org, team)
+	if err := g.r.List(ctx, path, nil).All(&ghusers); err != nil {
+		log.Fatalf("members of %s: %s", args.Team, err)
+	}
+	for _, u := range ghusers {
+		if u.Login != args.User {
+			users = append(users, User{Id: u.Login, Name: u.Login})
+		}
+	}
+	return
 }
 
-func (g *Github) Query(path string, query url.Values) ([]map[string]interface{}, error) {
-	x, err := g.r.Do("GET", g.url+path, query, nil)
+type GithubPullRequest struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Head  string `json:"head"`
+	Base  string `json:"base"`
+}
+
+type GithubPR struct {
+	Number int    `json:"number"`
+	Url    string `json:"html_url"`
+	State  string `json:"state"`
+	Title  string `json:"title"`
+	Head   struct {
+		Ref string `json:"ref"`
+		Sha string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+func (pr *GithubPR) result() *Result {
+	return &Result{
+		Id:     pr.Number,
+		Url:    pr.Url,
+		State:  pr.State,
+		Source: pr.Head.Ref,
+		Target: pr.Base.Ref,
+		Title:  pr.Title,
+	}
+}
+
+type GithubReviewers struct {
+	Reviewers []string `json:"reviewers"`
+}
+
+type GithubLabels struct {
+	Labels []string `json:"labels"`
+}
+
+type GithubMerge struct {
+	Method  string `json:"merge_method"`
+	Message string `json:"commit_message,omitempty"`
+	// merge only if the head is still the one checked
+	Sha string `json:"sha"`
+}
+
+func (g *Github) repo() string {
+	return fmt.Sprintf("/repos/%s/%s", g.args.Owner, g.args.Repo)
+}
+
+func (g *Github) submit(ctx context.Context, subj, desc string, users []User) (pr GithubPR, err error) {
+	args := g.args
+	req := GithubPullRequest{
+		Title: subj,
+		Body:  desc,
+		Head:  args.Branch,
+		Base:  args.Upstream,
+	}
+	err = g.r.Call(ctx, "POST", g.repo()+"/pulls", nil, &req, &pr)
 	if err != nil {
-		log.Panic(err)
+		return
 	}
-	return x, err
+	if args.Verbose {
+		dump("pr", &pr)
+	}
+
+	if len(users) > 0 {
+		rv := GithubReviewers{}
+		for _, u := range users {
+			rv.Reviewers = append(rv.Reviewers, u.Id)
+		}
+		path := fmt.Sprintf("%s/pulls/%s/requested_reviewers", g.repo(), id(pr.Number))
+		if err := g.r.Call(ctx, "POST", path, nil, &rv, nil); err != nil {
+			log.Printf("requesting reviewers: %s", err)
+		}
+	}
+
+	labels := GithubLabels{}
+	for _, l := range strings.Split(args.Label, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels.Labels = append(labels.Labels, l)
+		}
+	}
+	if len(labels.Labels) > 0 {
+		path := fmt.Sprintf("%s/issues/%s/labels", g.repo(), id(pr.Number))
+		if err := g.r.Call(ctx, "POST", path, nil, &labels, nil); err != nil {
+			log.Printf("setting labels: %s", err)
+		}
+	}
+	return pr, nil
 }
 
-func (g *Github) Post(path string, data interface{}) ([]map[string]interface{}, error) {
-	return g.request("POST", path, data)
+func (g *Github) create(ctx context.Context) {
+	args := g.args
+	mctx, cancel := args.deadline(ctx)
+	fn := prepare(args, g.members(mctx))
+	cancel()
+	defer os.Remove(fn)
+
+	for {
+		subj, desc := edit(fn)
+		meta, desc := trailers(desc)
+		if strings.HasPrefix(subj, "!") {
+			return
+		}
+		args.Label = trailer(meta, "Github-Label")
+
+		actx, cancel := args.deadline(ctx)
+		pr, err := g.submit(actx, subj, desc, reviewers(meta))
+		if err == nil {
+			cancel()
+			util.Emit(pr.result())
+			break
+		}
+		// "A pull request already exists for owner:branch."
+		var aerr *rest.APIError
+		if errors.As(err, &aerr) && aerr.StatusCode == http.StatusUnprocessableEntity {
+			pr, lerr := g.pr(actx)
+			if lerr == nil {
+				cancel()
+				log.Print(aerr)
+				util.Emit(pr.result())
+				return
+			}
+			log.Print(lerr)
+		}
+		giveUp(actx, err, fn)
+		cancel()
+	}
 }
 
-func (g *Github) Put(path string, data interface{}) ([]map[string]interface{}, error) {
-	return g.request("PUT", path, data)
+// pr returns the open pull request of the branch, an error when there is
+// none or more than one.
+func (g *Github) pr(ctx context.Context) (*GithubPR, error) {
+	ctx = rest.Revalidate(ctx)
+	args := g.args
+	query := url.Values{
+		"state": []string{"open"},
+		"head":  []string{args.Owner + ":" + args.Branch},
+		"base":  []string{args.Upstream},
+	}
+	prs := []GithubPR{}
+	if err := g.r.List(ctx, g.repo()+"/pulls", query).Max(2).All(&prs); err != nil {
+		return nil, err
+	}
+	switch len(prs) {
+	case 0:
+		return nil, fmt.Errorf("no open pull request for %s into %s",
+			args.Branch, args.Upstream)
+	case 1:
+		return &prs[0], nil
+	}
+	return nil, fmt.Errorf("more than one open pull request for %s into %s",
+		args.Branch, args.Upstream)
 }
 
-func (g *Github) test() {
-	x := g.Get(g.args.args[0])
-	dump("result", x)
+type GithubStatus struct {
+	State string `json:"state"`
+	Total int    `json:"total_count"`
 }
 
-func (g *Github) create() {
+type GithubCheckRun struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
 }
 
-func (g *Github) merge() {
+// checks returns true while the statuses and check runs of sha are still
+// running, an error when one of them failed.
+func (g *Github) checks(ctx context.Context, sha string) (bool, error) {
+	st := GithubStatus{}
+	path := fmt.Sprintf("%s/commits/%s/status", g.repo(), sha)
+	if err := g.r.Call(ctx, "GET", path, nil, nil, &st); err != nil {
+		return false, err
+	}
+	pending := false
+	switch {
+	case st.Total == 0:
+	case st.State == "pending":
+		pending = true
+	case st.State != "success":
+		return false, fmt.Errorf("commit status is %s", st.State)
+	}
+
+	runs := []GithubCheckRun{}
+	path = fmt.Sprintf("%s/commits/%s/check-runs", g.repo(), sha)
+	query := url.Values{"per_page": []string{"100"}}
+	// the runs are wrapped in an object, the next page is in the Link header
+	it := g.r.List(ctx, path, query).Pages(rest.Cursor{Items: "check_runs"})
+	if err := it.All(&runs); err != nil {
+		return false, err
+	}
+	for _, r := range runs {
+		if r.Status != "completed" {
+			pending = true
+			continue
+		}
+		switch r.Conclusion {
+		case "success", "neutral", "skipped":
+		default:
+			return false, fmt.Errorf("check %s is %s", r.Name, r.Conclusion)
+		}
+	}
+	return pending, nil
+}
+
+func (g *Github) merge(ctx context.Context) {
+	// the state of the pull request and of its checks, not --max_age old
+	ctx = rest.Revalidate(ctx)
+	args := g.args
+	pr, err := g.pr(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		pending, err := g.checks(ctx, pr.Head.Sha)
+		if err != nil {
+			log.Fatalf("%s: %s", pr.Url, err)
+		}
+		if !pending {
+			break
+		}
+		log.Printf("%s: waiting for the checks", pr.Url)
+		select {
+		case <-time.After(checkInterval):
+		case <-ctx.Done():
+			log.Fatalf("%s: %s", pr.Url, ctx.Err())
+		}
+	}
+
+	atHead(ctx, pr.Url, pr.Head.Sha)
+	m := GithubMerge{Method: args.Method, Message: args.Message, Sha: pr.Head.Sha}
+	path := fmt.Sprintf("%s/pulls/%d/merge", g.repo(), pr.Number)
+	if err := g.r.Call(ctx, "PUT", path, nil, &m, nil); err != nil {
+		log.Fatal(err)
+	}
+	pr.State = "merged"
+
+	if args.Remove {
+		err := g.r.Delete(ctx, g.repo()+"/git/refs/heads/"+args.Branch)
+		if err != nil {
+			log.Printf("removing %s: %s", args.Branch, err)
+		}
+	}
+	util.Emit(pr.result())
 }
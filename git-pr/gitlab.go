@@ -1,9 +1,13 @@
-package main
+package gitpr
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gotools/rest"
+	"gotools/util"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -18,44 +22,19 @@ type Gitlab struct {
 func NewGitlab(args *Args) Git {
 	g := Gitlab{}
 	g.args = args
-	g.url = "https://git.eng.vmware.com/api/v4/"
-	g.r = rest.NewRest(g.url,
-		args.User, args.Password, args.Verbose)
+	g.url = strings.TrimRight(args.ApiUrl, "/")
+	g.r = newRest(args, g.url,
+		&rest.HeaderToken{Header: "PRIVATE-TOKEN", Token: args.Password})
+	g.r.Paginator = rest.GitlabPages{}
 	return &g
 }
 
-func (g *Gitlab) request(method, path string, data interface{}) ([]map[string]interface{}, error) {
-	x, err := g.r.Do(method, g.url+path, nil, data)
-	return x, err
-}
-
-func (g *Gitlab) Get(path string) []map[string]interface{} {
-	x, err := g.request("GET", path, nil)
-	if err != nil {
-		log.Panic(err)
-	}
-	return x
-}
-
-func (g *Gitlab) Query(path string, query url.Values) ([]map[string]interface{}, error) {
-	x, err := g.r.Do("GET", g.url+path, query, nil)
-	if err != nil {
-		log.Panic(err)
+func (g *Gitlab) test(ctx context.Context) {
+	var x interface{}
+	if err := g.r.Call(ctx, "GET", g.args.testPath(), nil, nil, &x); err != nil {
+		log.Fatal(err)
 	}
-	return x, err
-}
-
-func (g *Gitlab) Post(path string, data interface{}) ([]map[string]interface{}, error) {
-	return g.request("POST", path, data)
-}
-
-func (g *Gitlab) Put(path string, data interface{}) ([]map[string]interface{}, error) {
-	return g.request("PUT", path, data)
-}
-
-func (g *Gitlab) test() {
-	x := g.Get(g.args.args[0])
-	dump("result", x)
+	util.Emit(x)
 }
 
 type GitlabUser struct {
@@ -65,11 +44,13 @@ type GitlabUser struct {
 	State string `json:"state"`
 }
 
-func (g *Gitlab) members() (users []GitlabUser) {
+func (g *Gitlab) members(ctx context.Context) (users []GitlabUser) {
 	args := g.args
 
-	x := g.Get(fmt.Sprintf("/groups/%s/members", url.QueryEscape(args.Team)))
-	unpack(x, &users)
+	path := fmt.Sprintf("/groups/%s/members", url.QueryEscape(args.Team))
+	if err := g.r.List(ctx, path, nil).All(&users); err != nil {
+		log.Fatalf("members of %s: %s", args.Team, err)
+	}
 
 	return users
 }
@@ -89,13 +70,36 @@ type GitlabMR struct {
 	Iid       int    `json:"iid"`
 	ProjectId int    `json:"project_id"`
 	Url       string `json:"web_url"`
+	State     string `json:"state"`
+	Src       string `json:"source_branch"`
+	Dst       string `json:"target_branch"`
+	Title     string `json:"title"`
+	Sha       string `json:"sha"`
+	// mergeable, not_approved, ci_still_running, conflict, ... since 15.6
+	Detailed     string `json:"detailed_merge_status"`
+	MergeStatus  string `json:"merge_status"`
+	HeadPipeline *struct {
+		Status string `json:"status"`
+		Url    string `json:"web_url"`
+	} `json:"head_pipeline"`
+}
+
+func (mri *GitlabMR) result() *Result {
+	return &Result{
+		Id:     mri.Iid,
+		Url:    mri.Url,
+		State:  mri.State,
+		Source: mri.Src,
+		Target: mri.Dst,
+		Title:  mri.Title,
+	}
 }
 
 type GitlabMergeApprovers struct {
 	Id     int   `json:"id"`
 	Iid    int   `json:"iid"`
-	Users  []int `json:"approver_ids",omitempty`
-	Groups []int `json:"approver_group_ids",omitempty`
+	Users  []int `json:"approver_ids,omitempty"`
+	Groups []int `json:"approver_group_ids,omitempty"`
 }
 
 type GitlabMergeComment struct {
@@ -104,7 +108,7 @@ type GitlabMergeComment struct {
 	Body string `json:"body"`
 }
 
-func (g *Gitlab) submit(subj, desc string, ids []int) (mri GitlabMR, err error) {
+func (g *Gitlab) submit(ctx context.Context, subj, desc string, ids []int) (mri GitlabMR, err error) {
 
 	args := g.args
 	proj := url.QueryEscape(args.Owner + "/" + args.Repo)
@@ -117,15 +121,16 @@ func (g *Gitlab) submit(subj, desc string, ids []int) (mri GitlabMR, err error)
 		Labels: args.Label,
 		Remove: args.Remove,
 	}
-	path := fmt.Sprintf("projects/%s/merge_requests", proj)
+	path := fmt.Sprintf("/projects/%s/merge_requests", proj)
 
-	resp, err := g.Post(path, &mr)
+	err = g.r.Call(ctx, "POST", path, nil, &mr, &mri)
 	if err != nil {
-		log.Panic(err)
+		return
 	}
 
-	unpack(resp[0], &mri)
-	dump("mr:", &mri)
+	if args.Verbose {
+		dump("mr", &mri)
+	}
 	mra := GitlabMergeApprovers{
 		Id:     mri.Id,
 		Iid:    mri.Iid,
@@ -133,21 +138,21 @@ func (g *Gitlab) submit(subj, desc string, ids []int) (mri GitlabMR, err error)
 		Groups: []int{},
 	}
 
-	path = fmt.Sprintf("projects/%d/merge_requests/%d/approvers",
-		mri.ProjectId, mri.Iid)
+	path = fmt.Sprintf("/projects/%s/merge_requests/%s/approvers",
+		proj, id(mri.Iid))
 
-	resp, err = g.Put(path, &mra)
+	err = g.r.Call(ctx, "PUT", path, nil, &mra, nil)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("setting approvers: %s", err)
 	}
-	return
+	return mri, nil
 }
 
-func (g *Gitlab) comment(mri *GitlabMR, url string) {
+func (g *Gitlab) comment(ctx context.Context, mri *GitlabMR, url string) {
 	body := expand(g.args, commentBody, url)
 
-	path := fmt.Sprintf("projects/%d/merge_requests/%d/notes",
-		mri.ProjectId, mri.Iid)
+	path := fmt.Sprintf("/projects/%d/merge_requests/%s/notes",
+		mri.ProjectId, id(mri.Iid))
 
 	note := GitlabMergeComment{
 		Id:   mri.Id,
@@ -155,15 +160,17 @@ func (g *Gitlab) comment(mri *GitlabMR, url string) {
 		Body: body,
 	}
 
-	_, err := g.Post(path, &note)
+	err := g.r.Call(ctx, "POST", path, nil, &note, nil)
 	if err != nil {
-		log.Panic(err)
+		log.Fatalf("comment: %s", err)
 	}
 }
 
-func (g *Gitlab) create() {
+func (g *Gitlab) create(ctx context.Context) {
 	args := g.args
-	members := g.members()
+	mctx, cancel := args.deadline(ctx)
+	members := g.members(mctx)
+	cancel()
 	users := []User{}
 	for _, u := range members {
 		if u.Id != args.User && u.State != "blocked" {
@@ -195,14 +202,33 @@ func (g *Gitlab) create() {
 			}
 		}
 
-		_, err := g.submit(subj, desc, ids)
+		actx, cancel := args.deadline(ctx)
+		mri, err := g.submit(actx, subj, desc, ids)
 		if err == nil {
+			cancel()
+			util.Emit(mri.result())
 			break
 		}
+		var aerr *rest.APIError
+		if errors.As(err, &aerr) && aerr.StatusCode == http.StatusConflict {
+			mri, lerr := g.mr(actx)
+			if lerr == nil {
+				cancel()
+				log.Printf("%s", aerr.Message)
+				util.Emit(mri.result())
+				return
+			}
+			log.Print(lerr)
+		}
+		giveUp(actx, err, fn)
+		cancel()
 	}
 }
 
-func (g *Gitlab) mr() *GitlabMR {
+// mr returns the open merge request of the branch, an error when there is
+// none or more than one.
+func (g *Gitlab) mr(ctx context.Context) (*GitlabMR, error) {
+	ctx = rest.Revalidate(ctx)
 	args := g.args
 	proj := url.QueryEscape(args.Owner + "/" + args.Repo)
 
@@ -211,21 +237,132 @@ func (g *Gitlab) mr() *GitlabMR {
 		"source_branch": []string{args.Branch},
 		"target_branch": []string{args.Upstream},
 	}
-	path := fmt.Sprintf("projects/%s/merge_requests", proj)
+	path := fmt.Sprintf("/projects/%s/merge_requests", proj)
 
-	mri := GitlabMR{}
+	mrs := []GitlabMR{}
+	if err := g.r.List(ctx, path, query).Max(2).All(&mrs); err != nil {
+		return nil, err
+	}
+	switch len(mrs) {
+	case 0:
+		return nil, fmt.Errorf("no open merge request for %s into %s",
+			args.Branch, args.Upstream)
+	case 1:
+		return &mrs[0], nil
+	}
+	return nil, fmt.Errorf("more than one open merge request for %s into %s",
+		args.Branch, args.Upstream)
+}
+
+type GitlabApprovals struct {
+	Left int `json:"approvals_left"`
+}
 
-	resp, err := g.Query(path, query)
-	if err != nil || len(resp) != 1 {
-		return nil
-		//log.Panic("no mr %s", err)
+type GitlabMergeAccept struct {
+	Message       string `json:"merge_commit_message,omitempty"`
+	SquashMessage string `json:"squash_commit_message,omitempty"`
+	Squash        bool   `json:"squash"`
+	Remove        bool   `json:"should_remove_source_branch"`
+	Auto          bool   `json:"merge_when_pipeline_succeeds"`
+	// refused unless still the head of the source branch
+	Sha string `json:"sha"`
+}
+
+// what the detailed_merge_status values other than mergeable mean
+var gitlabBlockers = map[string]string{
+	"blocked_status":           "blocked by another merge request",
+	"conflict":                 "conflicts with the target branch",
+	"discussions_not_resolved": "discussions are not resolved",
+	"draft_status":             "it is a draft",
+	"external_status_checks":   "external status checks have not passed",
+	"jira_association_missing": "the title or description does not reference a Jira issue",
+	"need_rebase":              "it needs a rebase",
+	"not_open":                 "it is not open",
+	"policies_denied":          "denied by a policy",
+	"requested_changes":        "a reviewer requested changes",
+}
+
+// blockers says why mri can't be merged now, pipelines still running are
+// fine when GitLab is to merge once they succeed.
+func (g *Gitlab) blockers(ctx context.Context, mri *GitlabMR) (r []string) {
+	path := fmt.Sprintf("/projects/%d/merge_requests/%d/approvals",
+		mri.ProjectId, mri.Iid)
+	appr := GitlabApprovals{}
+	if err := g.r.Call(ctx, "GET", path, nil, nil, &appr); err != nil {
+		log.Printf("approvals: %s", err)
+	} else if appr.Left > 0 {
+		r = append(r, fmt.Sprintf("needs %d more approvals", appr.Left))
+	}
+
+	if p := mri.HeadPipeline; p != nil {
+		switch p.Status {
+		case "success", "skipped", "manual":
+		case "created", "waiting_for_resource", "preparing", "pending", "running", "scheduled":
+			if !g.args.WhenPipelineSucceeds {
+				r = append(r, fmt.Sprintf("pipeline is %s %s, see --when_pipeline_succeeds",
+					p.Status, p.Url))
+			}
+		default:
+			r = append(r, fmt.Sprintf("pipeline %s %s", p.Status, p.Url))
+		}
 	}
 
-	unpack(resp[0], &mri)
-	return &mri
+	if msg, ok := gitlabBlockers[mri.Detailed]; ok {
+		r = append(r, msg)
+	} else if mri.Detailed == "" && mri.MergeStatus == "cannot_be_merged" {
+		r = append(r, gitlabBlockers["conflict"])
+	}
+	return
 }
 
-func (g *Gitlab) merge() {
-	mri := g.mr()
-	dump("mr:", mri)
+func (g *Gitlab) merge(ctx context.Context) {
+	// the state of the merge request, not --max_age old
+	ctx = rest.Revalidate(ctx)
+	args := g.args
+	mri, err := g.mr(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if args.Method == "rebase" {
+		log.Fatalf("--method rebase: GitLab merges the way the project is set up to, " +
+			"use merge or squash")
+	}
+
+	// the list lacks the pipeline and merge status
+	path := fmt.Sprintf("/projects/%d/merge_requests/%d", mri.ProjectId, mri.Iid)
+	if err := g.r.Call(ctx, "GET", path, nil, nil, mri); err != nil {
+		log.Fatal(err)
+	}
+
+	atHead(ctx, mri.Url, mri.Sha)
+
+	if b := g.blockers(ctx, mri); len(b) > 0 {
+		log.Fatalf("%s can't be merged: %s", mri.Url, strings.Join(b, "; "))
+	}
+
+	m := GitlabMergeAccept{
+		Message: args.Message,
+		Squash:  args.Method == "squash",
+		Remove:  args.Remove,
+		Auto:    args.WhenPipelineSucceeds,
+		Sha:     mri.Sha,
+	}
+	if m.Squash {
+		m.SquashMessage = args.Message
+	}
+	err = g.r.Call(ctx, "PUT", path+"/merge", nil, &m, mri)
+	var aerr *rest.APIError
+	if errors.As(err, &aerr) {
+		switch aerr.StatusCode {
+		case http.StatusMethodNotAllowed, http.StatusNotAcceptable:
+			// approvals, pipeline or conflicts changed meanwhile
+			log.Fatalf("%s can't be merged: %s", mri.Url, aerr.Message)
+		case http.StatusConflict:
+			log.Fatalf("%s: the source branch moved: %s", mri.Url, aerr.Message)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	util.Emit(mri.result())
 }
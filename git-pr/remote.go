@@ -0,0 +1,143 @@
+package gitpr
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// the providers of the well known hosts, the others are set with --hosts
+// or guessed from their names
+var providers = map[string]string{
+	"github.com":    "github",
+	"gitlab.com":    "gitlab",
+	"bitbucket.org": "bitbucket",
+
+	"git.eng.vmware.com": "gitlab",
+}
+
+// Remote is what git-pr needs of a remote url.
+type Remote struct {
+	// the host of the web UI and API, with the port of http(s) urls,
+	// IPv6 addresses in brackets
+	Host string
+	// the context path of Bitbucket Server, like /bitbucket, empty when
+	// it is served at the root
+	Path string
+	// the owner, or group/subgroup of GitLab
+	Namespace string
+	Repo      string
+}
+
+// parseRemote parses the remote urls of git:
+//
+//	[user@]host:namespace/repo[.git]
+//	[user@][ipv6]:namespace/repo[.git], [user@][host:port]:namespace/repo[.git]
+//	ssh://[user@]host[:port]/namespace/repo[.git]
+//	https://[user[:password]@]host[:port][/context]/namespace/repo[.git][/]
+//
+// Bitbucket Server serves its http ones under /scm/, below its context
+// path if any.
+func parseRemote(r string) (*Remote, error) {
+	var host, path, context string
+	shown := r
+	if strings.Contains(r, "://") {
+		u, err := url.Parse(r)
+		if err != nil {
+			return nil, err
+		}
+		shown = u.Redacted()
+		host, path = u.Hostname(), u.Path
+		switch u.Scheme {
+		case "http", "https":
+			host = u.Host
+			if i := strings.Index(path, "/scm/"); i >= 0 {
+				context, path = path[:i], path[i+len("/scm/"):]
+			}
+		case "ssh", "git", "git+ssh", "ssh+git":
+		default:
+			return nil, fmt.Errorf("unsupported remote url %q", shown)
+		}
+	} else {
+		// scp-like, a colon before any slash, the host in brackets when
+		// it is an IPv6 address or comes with the ssh port
+		s := r
+		if i := strings.IndexAny(s, "@:/["); i >= 0 && s[i] == '@' {
+			s = s[i+1:]
+		}
+		if strings.HasPrefix(s, "[") {
+			i := strings.Index(s, "]:")
+			if i < 0 {
+				return nil, fmt.Errorf("%q is not a remote url", r)
+			}
+			host, path = s[1:i], s[i+2:]
+			if j := strings.LastIndex(host, "@"); j >= 0 {
+				host = host[j+1:]
+			}
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		} else {
+			i := strings.Index(s, ":")
+			if i < 0 || strings.Contains(s[:i], "/") {
+				return nil, fmt.Errorf("%q is not a remote url", r)
+			}
+			host, path = s[:i], s[i+1:]
+		}
+	}
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") &&
+		net.ParseIP(host) != nil {
+		host = "[" + host + "]"
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	i := strings.LastIndex(path, "/")
+	if host == "" || i <= 0 || i == len(path)-1 {
+		return nil, fmt.Errorf("can't find owner/repo in remote url %q", shown)
+	}
+	return &Remote{Host: host, Path: strings.TrimRight(context, "/"),
+		Namespace: path[:i], Repo: path[i+1:]}, nil
+}
+
+// provider returns the backend of host, empty when it can't tell.
+func provider(host string, hosts map[string]string) string {
+	if p, ok := hosts[host]; ok {
+		return p
+	}
+	if p, ok := providers[host]; ok {
+		return p
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return provider(h, hosts)
+	}
+	for _, p := range []string{"github", "gitlab", "bitbucket"} {
+		if strings.Contains(host, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// apiUrl is where the API of a provider lives on host, below the context
+// path of the server.
+func apiUrl(git, host, path string) string {
+	switch git {
+	case "github":
+		if host == "" || host == "github.com" {
+			return "https://api.github.com"
+		}
+		return "https://" + host + "/api/v3"
+	case "gitlab":
+		if host == "" {
+			host = "gitlab.com"
+		}
+		return "https://" + host + "/api/v4"
+	case "bitbucket":
+		if host == "" || host == "bitbucket.org" {
+			return "https://api.bitbucket.org/2.0"
+		}
+		return "https://" + host + path + "/rest/api/1.0"
+	}
+	return ""
+}
@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	cloud.google.com/go v0.81.0
+	github.com/BurntSushi/toml v1.2.1
 	github.com/aws/aws-sdk-go v1.38.40
 	github.com/compose-spec/compose-go v1.0.1
 	github.com/pkg/sftp v1.13.0
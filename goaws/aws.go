@@ -1,21 +1,14 @@
-package main
+package goaws
 
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/json"
-	"flag"
-	"fmt"
 	"gotools/util"
 	"log"
 	"os"
-	"os/user"
-	"path"
-	"reflect"
 	"strings"
 	"text/template"
 	"time"
-	"unsafe"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -25,61 +18,41 @@ import (
 )
 
 type Args struct {
-	Region    string `json:"region"`
-	Image     string `json:"image"`
-	Type      string `json:"type"`
-	Key       string `json:"key"`
-	Name      string `json:"name"`
-	Owner     string `json:"owner"`
+	Region    string `json:"region" help:"AWS region" required:"true"`
+	Image     string `json:"image" help:"AMI id or Name tag of the image" required:"type!=-|none"`
+	Type      string `json:"type" help:"instance type, '-' to only update DNS, 'none' to delete" required:"true"`
+	Key       string `json:"key" help:"EC2 key pair name" required:"type!=-|none"`
+	Name      string `json:"name" help:"instance Name tag and DNS host name" required:"true"`
+	Owner     string `json:"owner" help:"instance Owner tag"`
 	User      string `json:"user"`
-	Subnet    string `json:"subnet"`
-	Nic       string `json:"nic"`
-	Disk      uint64 `json:"disk"`
-	Group     string `json:"group"`
-	Domain    string `json:"domain"`
-	AccessKey string `json:"access_key"`
-	SecretKey string `json:"secret_key"`
-	Token     string `json:"token"`
+	Subnet    string `json:"subnet" help:"subnet id of the primary interface" required:"type!=-|none" pattern:"^subnet-"`
+	Nic       string `json:"nic" help:"subnet id of an optional second interface" pattern:"^subnet-" requires:"group"`
+	Disk      uint64 `json:"disk" help:"root volume size, GB"`
+	Group     string `json:"group" help:"security group id" required:"type!=-|none" pattern:"^sg-"`
+	Domain    string `json:"domain" help:"Route53 zone to register the instance in"`
+	AccessKey string `json:"access_key" secret:"true" requires:"secret_key"`
+	SecretKey string `json:"secret_key" secret:"true"`
+	Token     string `json:"token" secret:"true"`
 	Verbose   bool   `json:"verbose"`
-	UserData  string `json:"user_data"`
+	UserData  string `json:"user_data" help:"cloud-init template file"`
 }
 
-func load(a *Args) {
-	user, err := user.Current()
-	if err != nil {
-		return
-	}
-	a.User = user.Username
-	a.Owner = user.Name
-	if a.Owner == "" {
-		a.Owner = user.Username
-	}
-	fn := path.Join(user.HomeDir, ".aws.json")
-
-	if f, err := os.Open(fn); err == nil {
-		defer f.Close()
-		p := json.NewDecoder(f)
-		p.Decode(a)
-	}
-
+// Instance is the result printed on stdout.
+type Instance struct {
+	Action    string `json:"action"`
+	Id        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Ip        string `json:"ip,omitempty"`
+	PrivateIp string `json:"private_ip,omitempty"`
+	Dns       string `json:"dns,omitempty"`
+	Nic       string `json:"nic,omitempty"`
 }
 
-func parse(a *Args) {
-	v := reflect.ValueOf(a).Elem()
-	t := v.Type()
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
-		name := f.Name
-		tag := f.Tag.Get("json")
-		if tag != "" {
-			name = strings.Split(tag, ",")[0]
-		}
-		vf := v.Field(i)
-		p := (*string)(unsafe.Pointer(vf.UnsafeAddr()))
-		flag.StringVar(p, name, *p, "")
-
+func dnsName(args *Args) string {
+	if args.Domain == "" {
+		return ""
 	}
-	flag.Parse()
+	return args.Name + "." + strings.TrimRight(args.Domain, ".")
 }
 
 func update_dns(sess *session.Session, args *Args, ip string) {
@@ -106,14 +79,32 @@ func update_dns(sess *session.Session, args *Args, ip string) {
 	}
 
 	if args.Type == "-" || args.Type == "none" {
-		_, err = dns.ChangeResourceRecordSets(
+		if err = change_record(dns, id, "DELETE", args, ip); err != nil {
+			log.Printf("Error %s", err)
+			return
+		}
+	}
+
+	name := args.Name + "." + strings.TrimRight(args.Domain, ".")
+	log.Printf("Updating record %s : %s", name, ip)
+
+	if err = change_record(dns, id, "UPSERT", args, ip); err != nil {
+		log.Printf("Error %s", err)
+		return
+	}
+}
+
+func change_record(dns *route53.Route53, zone, action string, args *Args, ip string) error {
+	name := args.Name + "." + args.Domain
+	return util.Mutatef(func() error {
+		_, err := dns.ChangeResourceRecordSets(
 			&route53.ChangeResourceRecordSetsInput{
 				ChangeBatch: &route53.ChangeBatch{
 					Changes: []*route53.Change{
 						{
-							Action: aws.String("DELETE"),
+							Action: aws.String(action),
 							ResourceRecordSet: &route53.ResourceRecordSet{
-								Name: aws.String(args.Name + "." + args.Domain),
+								Name: aws.String(name),
 								Type: aws.String("A"),
 								TTL:  aws.Int64(30),
 								ResourceRecords: []*route53.ResourceRecord{
@@ -125,44 +116,10 @@ func update_dns(sess *session.Session, args *Args, ip string) {
 						},
 					},
 				},
-				HostedZoneId: aws.String(id),
+				HostedZoneId: aws.String(zone),
 			})
-
-		if err != nil {
-			log.Printf("Error %s", err)
-			return
-		}
-	}
-
-	name := args.Name + "." + strings.TrimRight(args.Domain, ".")
-	log.Printf("Updating record %s : %s", name, ip)
-
-	_, err = dns.ChangeResourceRecordSets(
-		&route53.ChangeResourceRecordSetsInput{
-			ChangeBatch: &route53.ChangeBatch{
-				Changes: []*route53.Change{
-					{
-						Action: aws.String("UPSERT"),
-						ResourceRecordSet: &route53.ResourceRecordSet{
-							Name: aws.String(args.Name + "." + args.Domain),
-							Type: aws.String("A"),
-							TTL:  aws.Int64(30),
-							ResourceRecords: []*route53.ResourceRecord{
-								{
-									Value: aws.String(ip),
-								},
-							},
-						},
-					},
-				},
-			},
-			HostedZoneId: aws.String(id),
-		})
-
-	if err != nil {
-		log.Printf("Error %s", err)
-		return
-	}
+		return err
+	}, "%s A %s %s", action, strings.TrimRight(name, "."), ip)
 }
 
 func find(args Args, svc *ec2.EC2) (ip string) {
@@ -238,21 +195,24 @@ func cleanup(args Args, svc *ec2.EC2) (ip string) {
 				}
 			}
 		}
-		_, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{
-			InstanceIds: ids,
-		})
+		err := util.Mutatef(func() error {
+			_, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{
+				InstanceIds: ids,
+			})
+			if err != nil {
+				return err
+			}
+			return svc.WaitUntilInstanceTerminated(
+				&ec2.DescribeInstancesInput{
+					InstanceIds: ids,
+				})
+		}, "TerminateInstances %s", strings.Join(aws.StringValueSlice(ids), " "))
 		if err != nil {
 			log.Printf("Error deleting %s", err)
 			return
 		}
-		err = svc.WaitUntilInstanceTerminated(
-			&ec2.DescribeInstancesInput{
-				InstanceIds: ids,
-			})
 		for _, n := range nids {
-			_, err = svc.DeleteNetworkInterface(&ec2.DeleteNetworkInterfaceInput{
-				NetworkInterfaceId: n,
-			})
+			delete_nic(svc, n)
 			log.Printf("Cleaning up %s", *n)
 		}
 	}
@@ -263,46 +223,92 @@ func cleanup(args Args, svc *ec2.EC2) (ip string) {
 		})
 
 	for _, n := range intfs.NetworkInterfaces {
-		_, err = svc.DeleteNetworkInterface(&ec2.DeleteNetworkInterfaceInput{
-			NetworkInterfaceId: n.NetworkInterfaceId,
-		})
+		err = delete_nic(svc, n.NetworkInterfaceId)
 		log.Printf("Cleaning up %s => %s", *n.NetworkInterfaceId, err)
 	}
 	return
 }
 
+func delete_nic(svc *ec2.EC2, id *string) error {
+	return util.Mutatef(func() error {
+		_, err := svc.DeleteNetworkInterface(&ec2.DeleteNetworkInterfaceInput{
+			NetworkInterfaceId: id,
+		})
+		return err
+	}, "DeleteNetworkInterface %s", *id)
+}
+
 func add_nic(args Args, svc *ec2.EC2, inst *string) (nic *string) {
 	if args.Nic == "" {
 		return
 	}
 
-	ni, err := svc.CreateNetworkInterface(&ec2.CreateNetworkInterfaceInput{
-		Groups:   []*string{aws.String(args.Group)},
-		SubnetId: aws.String(args.Nic),
-	})
+	var ni *ec2.CreateNetworkInterfaceOutput
+	err := util.Mutatef(func() (err error) {
+		ni, err = svc.CreateNetworkInterface(&ec2.CreateNetworkInterfaceInput{
+			Groups:   []*string{aws.String(args.Group)},
+			SubnetId: aws.String(args.Nic),
+		})
+		return
+	}, "CreateNetworkInterface %s group %s", args.Nic, args.Group)
 	if err != nil {
 		log.Printf("Could not create network interface %s", err)
 		return
 	}
 
-	_, err = svc.AttachNetworkInterface(&ec2.AttachNetworkInterfaceInput{
-		NetworkInterfaceId: ni.NetworkInterface.NetworkInterfaceId,
-		InstanceId:         inst,
-		DeviceIndex:        aws.Int64(1),
-	})
+	err = util.Mutatef(func() error {
+		_, err := svc.AttachNetworkInterface(&ec2.AttachNetworkInterfaceInput{
+			NetworkInterfaceId: ni.NetworkInterface.NetworkInterfaceId,
+			InstanceId:         inst,
+			DeviceIndex:        aws.Int64(1),
+		})
+		return err
+	}, "AttachNetworkInterface %s", aws.StringValue(inst))
 	if err != nil {
 		log.Printf("Could not attach interface %s", err)
 		return
 	}
-	nic = ni.NetworkInterface.NetworkInterfaceId
+	if ni != nil {
+		nic = ni.NetworkInterface.NetworkInterfaceId
+	}
 	return
 }
 
-func main() {
+func newSession(args *Args) *session.Session {
+	cred := credentials.NewStaticCredentials(
+		args.AccessKey, args.SecretKey, args.Token)
+	cfg := &aws.Config{
+		Region:      aws.String(args.Region),
+		Credentials: cred,
+	}
+	return session.Must(session.NewSession(cfg))
+}
+
+// Instances lists the Name tags of the instances for shell completion.
+func Instances(args *Args) (names []string) {
+	svc := ec2.New(newSession(args))
+	desc, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{})
+	if err != nil {
+		return
+	}
+	for _, r := range desc.Reservations {
+		for _, i := range r.Instances {
+			for _, t := range i.Tags {
+				if *t.Key == "Name" {
+					names = append(names, *t.Value)
+				}
+			}
+		}
+	}
+	return
+}
+
+func Main() {
 
 	args := Args{}
 
 	util.GetFlags(&args, "aws")
+	defer util.ShowPlan()
 
 	if args.Disk == 0 {
 		args.Disk = 1000
@@ -312,18 +318,14 @@ func main() {
 		util.Dump("args", args)
 	}
 
-	cred := credentials.NewStaticCredentials(
-		args.AccessKey, args.SecretKey, args.Token)
-	cfg := &aws.Config{
-		Region:      aws.String(args.Region),
-		Credentials: cred,
-	}
-	sess := session.Must(session.NewSession(cfg))
+	sess := newSession(&args)
 	svc := ec2.New(sess)
 
 	if args.Type == "-" {
 		ip := find(args, svc)
 		update_dns(sess, &args, ip)
+		util.Emit(&Instance{Action: "dns", Name: args.Name, Ip: ip,
+			Dns: dnsName(&args)})
 		return
 	}
 
@@ -331,6 +333,7 @@ func main() {
 
 	if args.Type == "none" {
 		update_dns(sess, &args, oldip)
+		util.Emit(&Instance{Action: "deleted", Name: args.Name, Ip: oldip})
 		return
 	}
 
@@ -410,11 +413,20 @@ func main() {
 		params.UserData = aws.String(string(str))
 	}
 
-	runResult, err := svc.RunInstances(params)
+	var runResult *ec2.Reservation
+	err = util.Mutatef(func() (err error) {
+		runResult, err = svc.RunInstances(params)
+		return
+	}, "RunInstances %s %s subnet %s", args.Type, args.Image, args.Subnet)
 	if err != nil {
 		log.Printf("Could not create instance %s", err)
 		return
 	}
+	if util.DryRun {
+		add_nic(args, svc, aws.String(args.Name))
+		update_dns(sess, &args, "<new ip>")
+		return
+	}
 
 	inst := runResult.Instances[0]
 	instanceID := *inst.InstanceId
@@ -428,6 +440,7 @@ func main() {
 	}
 
 	ip := ""
+	res := Instance{Action: "created", Id: instanceID, Name: args.Name}
 	for {
 		desc, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
 			InstanceIds: []*string{&instanceID},
@@ -436,11 +449,16 @@ func main() {
 			log.Printf("Error describing %s : %s", instanceID, err)
 		}
 		if *desc.Reservations[0].Instances[0].State.Code > 0 {
-			fmt.Printf("%s\n", desc)
-			if desc.Reservations[0].Instances[0].PublicIpAddress != nil {
-				ip = *desc.Reservations[0].Instances[0].PublicIpAddress
+			if args.Verbose {
+				log.Printf("%s", desc)
+			}
+			i := desc.Reservations[0].Instances[0]
+			res.PrivateIp = aws.StringValue(i.PrivateIpAddress)
+			if i.PublicIpAddress != nil {
+				ip = *i.PublicIpAddress
+				res.Ip = ip
 			} else {
-				ip = *desc.Reservations[0].Instances[0].PrivateIpAddress
+				ip = *i.PrivateIpAddress
 			}
 			log.Printf("Created instance %s: %s", instanceID, ip)
 			break
@@ -465,4 +483,9 @@ func main() {
 
 	update_dns(sess, &args, ip)
 
+	res.Nic = aws.StringValue(nic)
+	if ip != "" {
+		res.Dns = dnsName(&args)
+	}
+	util.Emit(&res)
 }
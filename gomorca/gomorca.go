@@ -1,4 +1,4 @@
-package main
+package gomorca
 
 import (
 	"crypto/rand"
@@ -265,7 +265,7 @@ type Args struct {
 	Servers    int `json:"servers"`
 }
 
-func main() {
+func Main() {
 	//m := MorCA{}
 	//m.root()
 	foo()
@@ -4,7 +4,7 @@
 
 // This program can be used as go_android_GOARCH_exec by the Go tool.
 // It executes binaries on an android device using adb.
-package main
+package gossh
 
 import (
 	"bytes"
@@ -186,7 +186,7 @@ func run(c *ssh.Client, prog string, args ...string) error {
 	return err
 }
 
-func main() {
+func Main() {
 	log.SetFlags(0)
 	log.SetPrefix(os.Args[0] + ": ")
 
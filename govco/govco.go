@@ -1,9 +1,8 @@
-package main
+package govco
 
 // Forward from local port 9000 to remote port 9999
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"flag"
@@ -17,6 +16,7 @@ import (
 	"time"
 
 	"encoding/binary"
+	"gotools/util"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -68,7 +68,6 @@ func merge(x *map[string]interface{}, y *map[string]interface{}) {
 				y := map[string]interface{}(v)
 				merge(&x, &y)
 				continue
-				break
 			default:
 				(*x)[k] = v
 				break
@@ -103,37 +102,10 @@ func merge(x *map[string]interface{}, y *map[string]interface{}) {
 	}
 }
 
-func LinePosFromOff(r io.Reader, off int64) (lineno int, pos int64, err error) {
-	br := bufio.NewReader(r)
-	lineno = 1
-	pos = off - 1
-
-	var line []byte
-	var trunc bool
-
-	for {
-		line, trunc, err = br.ReadLine()
-		if err != nil {
-			return
-		}
-
-		if int64(len(line)) > pos {
-			return
-		}
-
-		pos -= int64(len(line) + 1)
-
-		if !trunc {
-			lineno += 1
-		}
-	}
-	return
-}
-
 func json_error(r io.Reader, err error) error {
 	if serr, ok := err.(*json.SyntaxError); ok {
-		line, col, _ := LinePosFromOff(r, serr.Offset)
-		return fmt.Errorf("%d:%d: %v", line, col, err)
+		line, col, _ := util.LinePosFromOff(r, serr.Offset)
+		return fmt.Errorf("%d:%d: %v", line, col+1, err)
 	}
 	return err
 }
@@ -203,7 +175,7 @@ func rpc_read(c io.Reader) []byte {
 	return resp
 }
 
-func main() {
+func Main() {
 
 	var args struct {
 		host     string
@@ -220,8 +192,11 @@ func main() {
 	flag.StringVar(&args.file, "file", "", "rpc file")
 	flag.StringVar(&args.set, "json", "", "set specific value {\"foo\":\"bar\"}")
 	flag.BoolVar(&args.verbose, "verbose", false, "verbose")
+	flag.BoolVar(&util.DryRun, "dry-run", false,
+		"print the update to be sent, without its settings, instead of sending it")
 
 	flag.Parse()
+	defer util.ShowPlan()
 
 	data := map[string]interface{}{}
 	if args.file != "" {
@@ -335,14 +310,18 @@ func main() {
 
 	rpc, _ = json.Marshal(&req)
 
-	log.Printf("sending update")
-	rpc_write(sshConn, rpc)
+	// the plan names only the target, the settings may hold credentials
+	util.Mutatef(func() error {
+		log.Printf("sending update")
+		rpc_write(sshConn, rpc)
 
-	log.Printf("getting response")
-	resp = rpc_read(sshConn)
+		log.Printf("getting response")
+		resp = rpc_read(sshConn)
 
-	if args.verbose {
-		log.Printf("response: %s", resp)
-	}
+		if args.verbose {
+			log.Printf("response: %s", resp)
+		}
+		return nil
+	}, "%s %s on %s", req.Method, settings.Module, args.host)
 
 }
@@ -1,16 +1,19 @@
-package main
+package jenkins
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"gotools/rest"
 	"gotools/util"
-	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	japi "github.com/yosida95/golang-jenkins"
 )
@@ -21,74 +24,59 @@ func dump(v interface{}) string {
 	return fmt.Sprintf("%s", out)
 }
 
-type Progress struct {
-	src   io.Reader
-	total int
-	size  int
-}
-
-func (p *Progress) Read(b []byte) (n int, err error) {
-	n, err = p.src.Read(b)
-
-	p.total += n
-	fmt.Printf("%d of %d, %d%%\r", p.total, p.size, p.total*100/p.size)
-	return
-}
-
-func GetArtifact(args *Args, jenkins *japi.Jenkins, build japi.Build, artifact japi.Artifact) error {
-	requestUrl := fmt.Sprintf("%s/artifact/%s", build.Url, artifact.RelativePath)
-	req, err := http.NewRequest("GET", requestUrl, nil)
-	if err != nil {
-		return err
-	}
-
-	req.SetBasicAuth(args.User, args.Token)
-
-	res, err := args.client.Do(req)
-	if err != nil {
-		return err
+func progress(done, total int64) {
+	if total > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d, %d%%\r", done, total, done*100/total)
+	} else {
+		fmt.Fprintf(os.Stderr, "%d\r", done)
 	}
+}
 
-	defer res.Body.Close()
-	p := &Progress{
-		src:  res.Body,
-		size: int(res.ContentLength),
-	}
+func GetArtifact(ctx context.Context, args *Args, build japi.Build, artifact japi.Artifact) (string, error) {
+	r := rest.NewRest(strings.TrimRight(build.Url, "/"), &rest.BasicAuth{User: args.User, Password: args.Token},
+		args.Verbose)
+	r.Client = args.client
 
 	fn := path.Join(args.Out, artifact.FileName)
 
 	f, err := os.Create(fn)
 	if err != nil {
-		return nil
+		return "", err
 	}
 	defer f.Close()
-	_, err = io.Copy(f, p)
-	fmt.Printf("\n")
-	return err
+	_, err = r.Download(ctx, "/artifact/"+artifact.RelativePath, nil, f, progress)
+	fmt.Fprintf(os.Stderr, "\n")
+	return fn, err
+}
+
+// Job and Artifacts are the results printed on stdout.
+type Job struct {
+	Name  string `json:"name"`
+	Url   string `json:"url"`
+	Color string `json:"color"`
+}
+
+type Artifacts struct {
+	Job   string   `json:"job"`
+	Build int      `json:"build"`
+	Url   string   `json:"url"`
+	Files []string `json:"files"`
 }
 
 type Args struct {
-	Cmd     string `json:"cmd"`
-	Host    string `json:"host"`
+	Cmd     string `json:"cmd" help:"ls lists the jobs, build starts --job, the artifacts of --job are downloaded when empty" oneof:"ls build"`
+	Host    string `json:"host" help:"Jenkins host name" required:"true"`
 	User    string `json:"user"`
-	Token   string `json:"token"`
-	Job     string `json:"job"`
-	Files   string `json:"files"`
-	Build   int    `json:"build"`
+	Token   string `json:"token" secret:"true" help:"Jenkins API token" requires:"user"`
+	Job     string `json:"job" required:"cmd!=ls"`
+	Files   string `json:"files" help:"glob of the artifacts to download"`
+	Build   int    `json:"build" help:"build number, last successful if not set"`
 	Verbose bool   `json:"verbose"`
-	Out     string `json:"out"`
+	Out     string `json:"out" help:"directory to download artifacts to"`
 	client  *http.Client
 }
 
-func main() {
-
-	args := Args{
-		Host: "jenkins2.eng.velocloud.net",
-		Job:  "master-nightly-build",
-	}
-
-	util.GetFlags(&args, "jenkins")
-
+func connect(args *Args) *japi.Jenkins {
 	auth := &japi.Auth{
 		Username: args.User,
 		ApiToken: args.Token,
@@ -102,26 +90,56 @@ func main() {
 	}
 	args.client = &http.Client{Transport: tr}
 	jenkins.SetHTTPClient(args.client)
+	return jenkins
+}
+
+// Jobs lists the job names for shell completion.
+func Jobs(args *Args) (names []string) {
+	jobs, err := connect(args).GetJobs()
+	if err != nil {
+		return
+	}
+	for _, j := range jobs {
+		names = append(names, j.Name)
+	}
+	return
+}
+
+func NewArgs() *Args {
+	return &Args{
+		Host: "jenkins2.eng.velocloud.net",
+		Job:  "master-nightly-build",
+	}
+}
+
+func Main() {
+
+	args := *NewArgs()
+
+	util.GetFlags(&args, "jenkins")
+	defer util.ShowPlan()
+	ctx, cancel := util.Interruptible(0)
+	defer cancel()
+
+	jenkins := connect(&args)
 
 	if args.Cmd == "ls" {
-		if args.Verbose {
-			jobs, err := jenkins.GetJobs()
-			if err != nil {
-				fmt.Printf("error getting jobs : %s\n", err)
-				return
-			}
-			for _, j := range jobs {
-				fmt.Printf("job %s\n", j.Name)
-			}
+		jobs, err := jenkins.GetJobs()
+		if err != nil {
+			log.Fatalf("error getting jobs : %s", err)
+		}
+		res := []Job{}
+		for _, j := range jobs {
+			res = append(res, Job{Name: j.Name, Url: j.Url, Color: j.Color})
 		}
+		util.Emit(res)
 		return
 	}
 
 	j, err := jenkins.GetJob(args.Job)
 
 	if err != nil {
-		fmt.Printf("error getting job %s : %s\n", args.Job, err)
-		return
+		log.Fatalf("error getting job %s : %s", args.Job, err)
 	}
 
 	if args.Cmd == "build" {
@@ -135,10 +153,13 @@ func main() {
 			"CICD_TESTBED_EXPIRE_TIME": []string{"2029-10-09"},
 			"STOP_ON_FAIL":             []string{"on"},
 		}
-		err := jenkins.Build(j, params)
+		err := util.Mutatef(func() error {
+			return jenkins.Build(j, params)
+		}, "build %s %s", j.Name, params.Encode())
 		if err != nil {
-			fmt.Printf("error starting job %s : %s\n", dump(j), err)
+			log.Fatalf("error starting job %s : %s", dump(j), err)
 		}
+		util.Emit(&Job{Name: j.Name, Url: j.Url, Color: j.Color})
 		return
 	}
 
@@ -147,23 +168,29 @@ func main() {
 	}
 	b, err := jenkins.GetBuild(j, args.Build)
 	if err != nil {
-		fmt.Printf("error getting build %d : %s\n", args.Build, err)
-		return
+		log.Fatalf("error getting build %d : %s", args.Build, err)
 	}
 
 	if args.Verbose {
 		o, _ := jenkins.GetBuildConsoleOutput(b)
-		fmt.Printf("\n%s\n", string(o))
+		fmt.Fprintf(os.Stderr, "\n%s\n", string(o))
 	}
 
+	res := Artifacts{Job: j.Name, Build: b.Number, Url: b.Url, Files: []string{}}
 	a := b.Artifacts
 	for _, x := range a {
 		if args.Verbose {
-			fmt.Printf("%s\n", x.FileName)
+			log.Printf("%s", x.FileName)
 		}
 		if m, _ := filepath.Match(args.Files, x.FileName); m {
-			fmt.Printf("%s\n", x.FileName)
-			GetArtifact(&args, jenkins, b, x)
+			log.Printf("%s", x.FileName)
+			fn, err := GetArtifact(ctx, &args, b, x)
+			if err != nil {
+				log.Printf("error getting %s : %s", x.FileName, err)
+				continue
+			}
+			res.Files = append(res.Files, fn)
 		}
 	}
+	util.Emit(&res)
 }
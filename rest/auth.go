@@ -0,0 +1,185 @@
+package rest
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Authenticator adds the credentials to a request before it is sent.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// BasicAuth is user and password, or app password for Bitbucket.
+type BasicAuth struct {
+	User, Password string
+}
+
+func (a *BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.User, a.Password)
+	return nil
+}
+
+// BearerToken sends Authorization: Bearer <token>.
+type BearerToken string
+
+func (t BearerToken) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+// HeaderToken sends the token as is in a header of its own, like GitLab's
+// PRIVATE-TOKEN.
+type HeaderToken struct {
+	Header, Token string
+}
+
+func (t *HeaderToken) Authenticate(req *http.Request) error {
+	req.Header.Set(t.Header, t.Token)
+	return nil
+}
+
+// TokenSource authenticates with oauth2 tokens, refreshed by the source as
+// they expire.
+type TokenSource struct {
+	oauth2.TokenSource
+}
+
+func (s *TokenSource) Authenticate(req *http.Request) error {
+	t, err := s.Token()
+	if err != nil {
+		return err
+	}
+	t.SetAuthHeader(req)
+	return nil
+}
+
+// GithubApp authenticates with the installation tokens of a GitHub app,
+// fetched through Rest, the client of the API, and reused until they
+// expire.
+type GithubApp struct {
+	Url          string
+	AppId        int64
+	Installation int64
+	Key          *rsa.PrivateKey
+	Rest         *Rest
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+func (a *GithubApp) Authenticate(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.tok.Valid() {
+		tok, err := a.token(req.Context())
+		if err != nil {
+			return err
+		}
+		a.tok = tok
+	}
+	a.tok.SetAuthHeader(req)
+	return nil
+}
+
+// NewGithubApp reads the PEM private key of the app from key, either the
+// key itself or a file name.
+func NewGithubApp(url string, id, installation int64, key string) (*GithubApp, error) {
+	if !strings.HasPrefix(key, "-----BEGIN") {
+		b, err := ioutil.ReadFile(key)
+		if err != nil {
+			return nil, err
+		}
+		key = string(b)
+	}
+	k, err := parseKey([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return &GithubApp{Url: url, AppId: id, Installation: installation, Key: k}, nil
+}
+
+func parseKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key")
+	}
+	return rk, nil
+}
+
+// jwt is the RS256 token the app authenticates itself with.
+func (a *GithubApp) jwt() (string, error) {
+	now := time.Now()
+	enc := base64.RawURLEncoding
+	head, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		// allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.AppId,
+	})
+	s := enc.EncodeToString(head) + "." + enc.EncodeToString(claims)
+	h := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return s + "." + enc.EncodeToString(sig), nil
+}
+
+// token exchanges the app JWT for an installation token.
+func (a *GithubApp) token(ctx context.Context) (*oauth2.Token, error) {
+	jwt, err := a.jwt()
+	if err != nil {
+		return nil, err
+	}
+	r := NewRest(strings.TrimRight(a.Url, "/"), nil, false)
+	if a.Rest != nil {
+		c := *a.Rest
+		r = &c
+	}
+	r.auth = BearerToken(jwt)
+	// needed by the reads of a dry run too
+	r.noPlan = true
+
+	var tok struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	path := fmt.Sprintf("%s/app/installations/%d/access_tokens",
+		strings.TrimRight(a.Url, "/"), a.Installation)
+	if err = r.Call(ctx, http.MethodPost, path, nil, nil, &tok); err != nil {
+		return nil, fmt.Errorf("github app installation token: %w", err)
+	}
+	return &oauth2.Token{
+		AccessToken: tok.Token,
+		TokenType:   "Bearer",
+		Expiry:      tok.ExpiresAt,
+	}, nil
+}
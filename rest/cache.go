@@ -0,0 +1,174 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache is a transport keeping the GET responses on disk, keyed by url and
+// credentials. They are revalidated with If-None-Match/If-Modified-Since
+// unless younger than MaxAge, a 304 does not count against the rate limits
+// of GitHub. Requests with Cache-Control: no-cache, see Revalidate, are
+// revalidated whatever their age and no-store ones skip the cache.
+type Cache struct {
+	Dir    string
+	MaxAge time.Duration
+	Next   http.RoundTripper
+}
+
+type cached struct {
+	URL        string      `json:"url"`
+	Status     string      `json:"status"`
+	StatusCode int         `json:"code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	Time       time.Time   `json:"time"`
+}
+
+type revalidateKey struct{}
+
+// Revalidate marks the requests sent with ctx as reads of a state that
+// changes, like the checks of a commit, they are sent with Cache-Control:
+// no-cache so that a Cache doesn't answer them from MaxAge.
+func Revalidate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, revalidateKey{}, true)
+}
+
+// CacheDir is the default directory of the Cache.
+func CacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "gotools", "http")
+}
+
+// NewCache returns a cache in dir, CacheDir when empty.
+func NewCache(dir string, maxAge time.Duration, next http.RoundTripper) *Cache {
+	if dir == "" {
+		dir = CacheDir()
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Cache{Dir: dir, MaxAge: maxAge, Next: next}
+}
+
+// key hashes the url with the credentials, different users may see
+// different things.
+func (c *Cache) key(req *http.Request) string {
+	h := sha256.New()
+	for _, k := range []string{"Authorization", "Private-Token"} {
+		h.Write([]byte(k + ":" + req.Header.Get(k) + "\n"))
+	}
+	h.Write([]byte(req.URL.String()))
+	return filepath.Join(c.Dir, hex.EncodeToString(h.Sum(nil)))
+}
+
+func (c *Cache) load(fn string) *cached {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	e := &cached{}
+	if json.Unmarshal(b, e) != nil {
+		return nil
+	}
+	return e
+}
+
+func (c *Cache) store(fn string, e *cached) {
+	b, _ := json.Marshal(e)
+	if os.MkdirAll(c.Dir, 0700) == nil {
+		ioutil.WriteFile(fn, b, 0600)
+	}
+}
+
+func (e *cached) response(req *http.Request) *http.Response {
+	h := e.Header.Clone()
+	h.Set("X-Gotools-Cache", "hit")
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+func (c *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	cc := req.Header.Get("Cache-Control")
+	if req.Method != http.MethodGet || strings.Contains(cc, "no-store") {
+		return c.Next.RoundTrip(req)
+	}
+	fn := c.key(req)
+	e := c.load(fn)
+	if e != nil && c.MaxAge > 0 && time.Since(e.Time) < c.MaxAge &&
+		!strings.Contains(cc, "no-cache") {
+		return e.response(req), nil
+	}
+
+	if e != nil {
+		req = req.Clone(req.Context())
+		if etag := e.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.Header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	resp, err := c.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && e != nil {
+		resp.Body.Close()
+		e.Time = time.Now()
+		// the 304 may carry fresher rate limit and paging headers
+		for k, v := range resp.Header {
+			e.Header[k] = v
+		}
+		c.store(fn, e)
+		return e.response(req), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	if resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" &&
+		c.MaxAge <= 0 {
+		return resp, nil
+	}
+	if strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.store(fn, &cached{
+		URL:        req.URL.String(),
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Time:       time.Now(),
+	})
+	return resp, nil
+}
@@ -0,0 +1,82 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		ctx     func(context.Context) context.Context
+		hits    int
+		matches int
+	}{
+		// every read is revalidated, the 304s are served from disk
+		{name: "etag", hits: 3, matches: 2},
+		// the fresh response is served without asking
+		{name: "max age", maxAge: time.Hour, hits: 1},
+		{name: "revalidate", maxAge: time.Hour, ctx: Revalidate, hits: 3, matches: 2},
+	}
+	for _, tt := range tests {
+		hits, matches := 0, 0
+		r, _ := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+			hits++
+			w.Header().Set("ETag", `"v1"`)
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				matches++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, `{"state": "open"}`)
+		})
+		r.Client.Transport = NewCache(t.TempDir(), tt.maxAge, nil)
+		ctx := context.Background()
+		if tt.ctx != nil {
+			ctx = tt.ctx(ctx)
+		}
+		for i := 0; i < 3; i++ {
+			var out struct{ State string }
+			if err := r.Call(ctx, "GET", "/x", nil, nil, &out); err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if out.State != "open" {
+				t.Errorf("%s: read %d got %+v", tt.name, i, out)
+			}
+		}
+		if hits != tt.hits || matches != tt.matches {
+			t.Errorf("%s: %d requests, %d not modified, want %d %d", tt.name,
+				hits, matches, tt.hits, tt.matches)
+		}
+	}
+}
+
+func TestCacheSkips(t *testing.T) {
+	hits := 0
+	r, _ := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+		hits++
+		if req.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	r.Client.Transport = NewCache(t.TempDir(), time.Hour, nil)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		for _, c := range []struct{ method, path string }{
+			{"POST", "/x"}, {"GET", "/private"}, {"GET", "/x"},
+		} {
+			if err := r.Call(ctx, c.method, c.path, nil, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// only the second GET /x is cached
+	if hits != 5 {
+		t.Errorf("%d requests, want 5", hits)
+	}
+}
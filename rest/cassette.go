@@ -0,0 +1,237 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Interaction is a request and its response as saved in a cassette.
+type Interaction struct {
+	Request struct {
+		Method string      `json:"method"`
+		URL    string      `json:"url"`
+		Header http.Header `json:"header,omitempty"`
+		Body   string      `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status     string      `json:"status"`
+		StatusCode int         `json:"code"`
+		Header     http.Header `json:"header,omitempty"`
+		Body       string      `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+const scrubbed = "REDACTED"
+
+// ErrNotRecorded is the error of the requests missing from the cassette
+// being replayed.
+var ErrNotRecorded = errors.New("no recorded response")
+
+// sensitive headers, query parameters and JSON keys, lower case
+var sensitive = []string{"authorization", "private-token", "cookie",
+	"set-cookie", "x-api-key", "token", "access_token", "private_token",
+	"password", "secret", "client_secret", "refresh_token"}
+
+func isSensitive(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range sensitive {
+		if k == s {
+			return true
+		}
+	}
+	return false
+}
+
+func scrubHeader(h http.Header) http.Header {
+	r := http.Header{}
+	for k, v := range h {
+		if isSensitive(k) {
+			v = []string{scrubbed}
+		}
+		r[k] = v
+	}
+	return r
+}
+
+// scrubURL also sorts the query so the urls can be compared as strings.
+func scrubURL(u *url.URL) string {
+	n := *u
+	if _, ok := n.User.Password(); ok {
+		n.User = url.UserPassword(n.User.Username(), scrubbed)
+	}
+	q := n.Query()
+	for k := range q {
+		if isSensitive(k) {
+			q.Set(k, scrubbed)
+		}
+	}
+	n.RawQuery = q.Encode()
+	return n.String()
+}
+
+func scrubJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			if isSensitive(k) {
+				v[k] = scrubbed
+			} else {
+				v[k] = scrubJSON(x)
+			}
+		}
+	case []interface{}:
+		for i, x := range v {
+			v[i] = scrubJSON(x)
+		}
+	}
+	return v
+}
+
+func scrubBody(b []byte) string {
+	var v interface{}
+	if json.Unmarshal(b, &v) != nil {
+		return string(b)
+	}
+	s, _ := json.Marshal(scrubJSON(v))
+	return string(s)
+}
+
+// Recorder is a transport that saves the interactions to a cassette file
+// with the secrets scrubbed or, replaying, serves them back from it and
+// fails the requests not found there.
+type Recorder struct {
+	File   string
+	Replay bool
+	// the transport of the recorded requests
+	Next http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+}
+
+// NewRecorder loads the cassette to replay, or starts a new one.
+func NewRecorder(file string, replay bool, next http.RoundTripper) (*Recorder, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	r := &Recorder{File: file, Replay: replay, Next: next}
+	if !replay {
+		return r, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &r.cassette); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	r.used = make([]bool, len(r.cassette.Interactions))
+	return r, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if r.Replay {
+		return r.replay(req)
+	}
+
+	resp, err := r.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rbody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(rbody))
+
+	i := &Interaction{}
+	i.Request.Method = req.Method
+	i.Request.URL = scrubURL(req.URL)
+	i.Request.Header = scrubHeader(req.Header)
+	i.Request.Body = scrubBody(body)
+	i.Response.Status = resp.Status
+	i.Response.StatusCode = resp.StatusCode
+	i.Response.Header = scrubHeader(resp.Header)
+	i.Response.Body = scrubBody(rbody)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, i)
+	// saved every time, the tools may exit anywhere
+	return resp, r.save()
+}
+
+func (r *Recorder) save() error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&r.cassette); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.File, b.Bytes(), 0600)
+}
+
+// replay serves the first unused interaction with the same method and url.
+func (r *Recorder) replay(req *http.Request) (*http.Response, error) {
+	u := scrubURL(req.URL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n, i := range r.cassette.Interactions {
+		if r.used[n] || i.Request.Method != req.Method || i.Request.URL != u {
+			continue
+		}
+		r.used[n] = true
+		h := i.Response.Header.Clone()
+		// the body was scrubbed
+		h.Del("Content-Length")
+		return &http.Response{
+			Status:        i.Response.Status,
+			StatusCode:    i.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        h,
+			Body:          ioutil.NopCloser(strings.NewReader(i.Response.Body)),
+			ContentLength: int64(len(i.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("%s: %w to %s %s", r.File, ErrNotRecorded,
+		req.Method, u)
+}
+
+// Unused lists the interactions of the cassette not replayed yet.
+func (r *Recorder) Unused() (l []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n, i := range r.cassette.Interactions {
+		if !r.used[n] {
+			l = append(l, i.Request.Method+" "+i.Request.URL)
+		}
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassette(t *testing.T) {
+	r, srv := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Set-Cookie", "session=c00kie")
+		fmt.Fprintf(w, `{"path": %q, "token": "r3fresh", "user": {"password": "hunter2"}}`,
+			req.URL.Path)
+	})
+	fn := filepath.Join(t.TempDir(), "cassette.json")
+	rec, err := NewRecorder(fn, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Client.Transport = rec
+	r.auth = BearerToken("s3cr3t")
+	ctx := context.Background()
+	query := url.Values{"private_token": {"pr1vate"}, "state": {"open"}}
+	for _, p := range []string{"/a", "/b", "/a"} {
+		if err := r.Call(ctx, "GET", p, query, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Call(ctx, "POST", "/a", nil, map[string]string{"secret": "sh"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"s3cr3t", "pr1vate", "c00kie", "r3fresh", "hunter2", `"sh"`} {
+		if strings.Contains(string(b), s) {
+			t.Errorf("%s in the cassette:\n%s", s, b)
+		}
+	}
+
+	// replayed in order without the server, whatever the token
+	srv.Close()
+	rep, err := NewRecorder(fn, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Client.Transport = rep
+	r.auth = BearerToken("other")
+	for _, p := range []string{"/a", "/b", "/a"} {
+		var out struct{ Path, Token string }
+		if err := r.Call(ctx, "GET", p, query, nil, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Path != p || out.Token != scrubbed {
+			t.Errorf("replayed %+v for %s", out, p)
+		}
+	}
+	if l := rep.Unused(); len(l) != 1 || l[0] != "POST "+srv.URL+"/a" {
+		t.Errorf("unused %q", l)
+	}
+
+	for _, p := range []string{"/a", "/c"} {
+		err = r.Call(ctx, "GET", p, query, nil, nil)
+		if !errors.Is(err, ErrNotRecorded) {
+			t.Errorf("%s: got %v", p, err)
+		}
+	}
+}
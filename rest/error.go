@@ -0,0 +1,140 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIError is a non-2xx response, with the message of the provider decoded
+// from the body when it has one.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	RequestId  string
+	// the message and the details, like the failed validations
+	Message string
+	Errors  []string
+	Body    []byte
+}
+
+func (e *APIError) Error() string {
+	s := fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	if len(e.Errors) > 0 {
+		s += " (" + strings.Join(e.Errors, "; ") + ")"
+	}
+	if e.RequestId != "" {
+		s += " [request " + e.RequestId + "]"
+	}
+	return s
+}
+
+func newAPIError(req *http.Request, resp *http.Response, body []byte) *APIError {
+	e := &APIError{
+		Method:     req.Method,
+		URL:        scrubURL(req.URL),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+	}
+	for _, k := range []string{"X-Request-Id", "X-GitHub-Request-Id"} {
+		if id := resp.Header.Get(k); id != "" {
+			e.RequestId = id
+			break
+		}
+	}
+	e.decode(body)
+	return e
+}
+
+// decode picks the message of
+//
+//	GitLab    {"message": "..." | ["..."] | {"field": ["..."]}} or {"error": "..."}
+//	GitHub    {"message": "...", "errors": [{"field": .., "message": ..} | "..."]}
+//	Bitbucket {"error": {"message": "...", "detail": "..." | {...}}}
+func (e *APIError) decode(body []byte) {
+	var m struct {
+		Message json.RawMessage `json:"message"`
+		Errors  json.RawMessage `json:"errors"`
+		Error   json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &m) != nil {
+		return
+	}
+
+	var bb struct {
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+	}
+	if json.Unmarshal(m.Error, &bb) == nil && bb.Message != "" {
+		e.Message = bb.Message
+		e.Errors = messages(bb.Detail, "")
+		return
+	}
+
+	msgs := messages(m.Message, "")
+	if len(msgs) == 0 {
+		msgs = messages(m.Error, "")
+	}
+	if len(msgs) > 0 {
+		e.Message = msgs[0]
+		e.Errors = msgs[1:]
+	}
+	e.Errors = append(e.Errors, messages(m.Errors, "")...)
+}
+
+// messages flattens a string, a list of them or of GitHub error objects,
+// or a map of field names to any of these.
+func messages(raw json.RawMessage, field string) (r []string) {
+	if len(raw) == 0 {
+		return nil
+	}
+	var v interface{}
+	if json.Unmarshal(raw, &v) != nil {
+		return nil
+	}
+	prefix := ""
+	if field != "" {
+		prefix = field + " "
+	}
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			r = append(r, prefix+v)
+		}
+	case []interface{}:
+		for _, x := range v {
+			b, _ := json.Marshal(x)
+			r = append(r, messages(b, field)...)
+		}
+	case map[string]interface{}:
+		// a GitHub error object
+		if msg, ok := v["message"].(string); ok {
+			if f, ok := v["field"].(string); ok {
+				msg = f + ": " + msg
+			}
+			return append(r, prefix+msg)
+		}
+		if code, ok := v["code"].(string); ok {
+			f, _ := v["field"].(string)
+			return append(r, strings.TrimSpace(prefix+f+" "+code))
+		}
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b, _ := json.Marshal(v[k])
+			r = append(r, messages(b, k)...)
+		}
+	}
+	return r
+}
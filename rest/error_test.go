@@ -0,0 +1,66 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPIErrorDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		message string
+		errors  string
+	}{
+		{"gitlab message", `{"message": "404 Project Not Found"}`,
+			"404 Project Not Found", ""},
+		{"gitlab list", `{"message": ["Another open merge request already exists", "Branch is missing"]}`,
+			"Another open merge request already exists", "Branch is missing"},
+		{"gitlab fields", `{"message": {"title": ["can't be blank"], "base": ["is invalid", "is old"]}}`,
+			"base is invalid", "base is old; title can't be blank"},
+		{"gitlab error", `{"error": "insufficient_scope", "scope": "api"}`,
+			"insufficient_scope", ""},
+		{"github", `{"message": "Validation Failed", "errors": [{"resource": "PullRequest", "field": "head", "code": "invalid"}, {"message": "No commits between main and x"}], "documentation_url": "https://docs"}`,
+			"Validation Failed", "head invalid; No commits between main and x"},
+		{"github field message", `{"message": "Validation Failed", "errors": [{"field": "base", "message": "is protected"}]}`,
+			"Validation Failed", "base: is protected"},
+		{"github strings", `{"message": "Bad", "errors": ["one", "two"]}`,
+			"Bad", "one; two"},
+		{"bitbucket", `{"type": "error", "error": {"message": "Bad request", "detail": "branch not found"}}`,
+			"Bad request", "branch not found"},
+		{"bitbucket fields", `{"type": "error", "error": {"message": "Bad request", "fields": {"x": 1}, "detail": {"source": ["not found"]}}}`,
+			"Bad request", "source not found"},
+		{"not json", `<html>Bad Gateway</html>`, "", ""},
+	}
+	for _, tt := range tests {
+		e := &APIError{}
+		e.decode([]byte(tt.body))
+		if e.Message != tt.message || strings.Join(e.Errors, "; ") != tt.errors {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, e.Message, e.Errors,
+				tt.message, tt.errors)
+		}
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	r, srv := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-GitHub-Request-Id", "AB:12")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"message": "Validation Failed", "errors": [{"field": "head", "code": "invalid"}]}`))
+	})
+	err := r.Call(context.Background(), "POST", "/pulls?access_token=s3cr3t", nil,
+		map[string]string{"head": "x"}, nil)
+	var aerr *APIError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("got %v", err)
+	}
+	want := "POST " + srv.URL + "/pulls?access_token=REDACTED: 422 Unprocessable Entity: " +
+		"Validation Failed (head invalid) [request AB:12]"
+	if err.Error() != want {
+		t.Errorf("got  %s\nwant %s", err, want)
+	}
+}
@@ -0,0 +1,154 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func (c *Rest) resolve(path string) string {
+	if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") {
+		return path
+	}
+	return c.url + path
+}
+
+// Call sends in, if not nil, as JSON and decodes the response into out, if
+// not nil. path is relative to the API url unless it is a full url.
+func (c *Rest) Call(ctx context.Context, method, path string, query url.Values,
+	in, out interface{}) error {
+
+	res, _, err := c.request(ctx, method, c.resolve(path), query, in)
+	if err != nil || out == nil || len(res) == 0 {
+		return err
+	}
+	return json.Unmarshal(res, out)
+}
+
+// Iter walks the items of a listing one page at a time:
+//
+//	it := r.List(ctx, "/groups/x/members", nil)
+//	for it.Next() {
+//		var u User
+//		if err := it.Decode(&u); err != nil {
+//			...
+//		}
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Stopping early leaves the remaining pages unfetched.
+type Iter struct {
+	c     *Rest
+	ctx   context.Context
+	next  string
+	query url.Values
+	max   int
+	n     int
+	items []json.RawMessage
+	cur   json.RawMessage
+	total int
+	err   error
+	pages Paginator
+}
+
+// List returns an iterator over the items of the listing at path.
+func (c *Rest) List(ctx context.Context, path string, query url.Values) *Iter {
+	return &Iter{c: c, ctx: ctx, next: c.resolve(path), query: query, total: -1}
+}
+
+// Pages reads the listing with p rather than the Paginator of the client,
+// for the endpoints that page differently from the rest of the API.
+func (it *Iter) Pages(p Paginator) *Iter {
+	it.pages = p
+	return it
+}
+
+// Max stops the iteration after n items, all of them when n <= 0.
+func (it *Iter) Max(n int) *Iter {
+	it.max = n
+	return it
+}
+
+// Next advances to the next item, fetching the next page when needed. It
+// returns false at the end of the listing or on error.
+func (it *Iter) Next() bool {
+	if it.err != nil || (it.max > 0 && it.n >= it.max) {
+		return false
+	}
+	for len(it.items) == 0 {
+		if it.next == "" {
+			return false
+		}
+		it.err = it.fetch()
+		if it.err != nil {
+			return false
+		}
+	}
+	it.cur, it.items = it.items[0], it.items[1:]
+	it.n++
+	return true
+}
+
+func (it *Iter) fetch() error {
+	u, err := url.Parse(it.next)
+	if err != nil {
+		return err
+	}
+	if it.query != nil {
+		u.RawQuery = it.query.Encode()
+	}
+	res, h, err := it.c.request(it.ctx, http.MethodGet, it.next, it.query, nil)
+	if err != nil {
+		return err
+	}
+	pages := it.pages
+	if pages == nil {
+		pages = it.c.Paginator
+	}
+	p, err := pages.Page(u, h, res)
+	if err != nil {
+		return err
+	}
+	// the next url carries the query
+	it.query = nil
+	it.items, it.next = p.Items, p.Next
+	if p.Total >= 0 {
+		it.total = p.Total
+	}
+	return nil
+}
+
+// Decode decodes the current item into v.
+func (it *Iter) Decode(v interface{}) error {
+	return json.Unmarshal(it.cur, v)
+}
+
+// Total is the size of the listing as reported by the server, -1 when it
+// does not say.
+func (it *Iter) Total() int {
+	return it.total
+}
+
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// All decodes the remaining items into the slice out points to.
+func (it *Iter) All(out interface{}) error {
+	var items []json.RawMessage
+	for it.Next() {
+		items = append(items, it.cur)
+	}
+	if it.err != nil {
+		return it.err
+	}
+	b, _ := json.Marshal(items)
+	if items == nil {
+		b = []byte("[]")
+	}
+	return json.Unmarshal(b, out)
+}
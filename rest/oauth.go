@@ -1,11 +1,10 @@
-package main
+package rest
 
 import (
 	"context"
 	"encoding/gob"
 	"fmt"
 	"hash/fnv"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -60,17 +59,19 @@ func saveToken(file string, token *oauth2.Token) {
 	gob.NewEncoder(f).Encode(token)
 }
 
-func newOAuthClient(ctx context.Context, config *oauth2.Config) *http.Client {
+// NewOAuthTokenSource returns the token source of config, starting from
+// the cached token or, the first time, the browser authorization flow.
+func NewOAuthTokenSource(ctx context.Context, config *oauth2.Config) *TokenSource {
 	cacheFile := tokenCacheFile(config)
 	token, err := tokenFromFile(cacheFile)
 	if err != nil {
 		token = tokenFromWeb(ctx, config)
 		saveToken(cacheFile, token)
 	} else {
-		log.Printf("Using cached token %#v from %q", token, cacheFile)
+		log.Printf("Using cached token from %q", cacheFile)
 	}
 
-	return config.Client(ctx, token)
+	return &TokenSource{config.TokenSource(ctx, token)}
 }
 
 func tokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
@@ -121,14 +122,3 @@ func openURL(url string) {
 	}
 	log.Printf("Error opening URL in browser.")
 }
-
-func valueOrFileContents(value string, filename string) string {
-	if value != "" {
-		return value
-	}
-	slurp, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Fatalf("Error reading %q: %v", filename, err)
-	}
-	return strings.TrimSpace(string(slurp))
-}
@@ -0,0 +1,165 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Page is one page of a listing.
+type Page struct {
+	Items []json.RawMessage
+	// url of the next page, empty on the last one
+	Next string
+	// number of items of the whole listing, -1 when unknown
+	Total int
+}
+
+// Paginator splits a response of a listing at u into its items and the
+// url of the next page. A response that is not a listing is a page of one.
+type Paginator interface {
+	Page(u *url.URL, h http.Header, body []byte) (*Page, error)
+}
+
+func items(body []byte) ([]json.RawMessage, error) {
+	var r []json.RawMessage
+	if len(body) > 0 && body[0] == '[' {
+		err := json.Unmarshal(body, &r)
+		return r, err
+	}
+	if len(body) > 0 {
+		r = append(r, json.RawMessage(body))
+	}
+	return r, nil
+}
+
+// withParam returns u with the query parameter k set to v.
+func withParam(u *url.URL, k, v string) string {
+	n := *u
+	q := n.Query()
+	q.Set(k, v)
+	n.RawQuery = q.Encode()
+	return n.String()
+}
+
+// LinkHeader follows the RFC 5988 rel="next" links, GitHub style.
+type LinkHeader struct{}
+
+func (LinkHeader) Page(u *url.URL, h http.Header, body []byte) (*Page, error) {
+	r, err := items(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{Items: r, Next: linkNext(h), Total: -1}, nil
+}
+
+// linkNext returns the rel="next" url of the Link headers.
+func linkNext(h http.Header) string {
+	for _, l := range h["Link"] {
+		for _, link := range strings.Split(l, ",") {
+			parts := strings.Split(link, ";")
+			for _, p := range parts[1:] {
+				p = strings.Replace(strings.TrimSpace(p), " ", "", -1)
+				if p == `rel="next"` || p == `rel=next` {
+					u := strings.TrimSpace(parts[0])
+					return strings.TrimSuffix(strings.TrimPrefix(u, "<"), ">")
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Cursor reads the items and the next page from fields of the body,
+// Bitbucket's {"values": [...], "next": url} is Cursor{"values", "next", ""}.
+// With Param set the next field is a cursor token sent as that query
+// parameter rather than a url. Without Next the next page is the one of the
+// Link header, as with GitHub's wrapped listings like check runs:
+// Cursor{Items: "check_runs"}.
+type Cursor struct {
+	Items, Next, Param string
+}
+
+func (c Cursor) Page(u *url.URL, h http.Header, body []byte) (*Page, error) {
+	var m map[string]json.RawMessage
+	if len(body) == 0 || body[0] != '{' {
+		r, err := items(body)
+		return &Page{Items: r, Total: -1}, err
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	raw, ok := m[c.Items]
+	if !ok {
+		return &Page{Items: []json.RawMessage{body}, Total: -1}, nil
+	}
+	p := &Page{Total: -1}
+	if err := json.Unmarshal(raw, &p.Items); err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Items, err)
+	}
+	if c.Next == "" {
+		p.Next = linkNext(h)
+		return p, nil
+	}
+	var next interface{}
+	json.Unmarshal(m[c.Next], &next)
+	switch n := next.(type) {
+	case string:
+		p.Next = n
+	case float64:
+		p.Next = strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	if c.Param != "" && p.Next != "" {
+		p.Next = withParam(u, c.Param, p.Next)
+	}
+	if size, ok := m["size"]; ok {
+		json.Unmarshal(size, &p.Total)
+	}
+	return p, nil
+}
+
+// GitlabPages follows GitLab's X-Next-Page header, it is empty on the last
+// page, X-Total gives the size of the listing.
+type GitlabPages struct{}
+
+func (GitlabPages) Page(u *url.URL, h http.Header, body []byte) (*Page, error) {
+	r, err := items(body)
+	if err != nil {
+		return nil, err
+	}
+	p := &Page{Items: r, Total: -1}
+	if n := h.Get("X-Next-Page"); n != "" {
+		p.Next = withParam(u, "page", n)
+	}
+	if t, err := strconv.Atoi(h.Get("X-Total")); err == nil {
+		p.Total = t
+	}
+	return p, nil
+}
+
+// Offset pages with offset and limit query parameters, the listing ends
+// with an empty or short page.
+type Offset struct {
+	Offset, Limit string
+}
+
+func (o Offset) Page(u *url.URL, h http.Header, body []byte) (*Page, error) {
+	r, err := items(body)
+	if err != nil {
+		return nil, err
+	}
+	p := &Page{Items: r, Total: -1}
+	if len(body) == 0 || body[0] != '[' || len(r) == 0 {
+		return p, nil
+	}
+	q := u.Query()
+	if limit, err := strconv.Atoi(q.Get(o.Limit)); err == nil && len(r) < limit {
+		return p, nil
+	}
+	off, _ := strconv.Atoi(q.Get(o.Offset))
+	p.Next = withParam(u, o.Offset, strconv.Itoa(off+len(r)))
+	return p, nil
+}
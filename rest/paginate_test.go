@@ -0,0 +1,110 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestPaginators(t *testing.T) {
+	tests := []struct {
+		name   string
+		p      Paginator
+		url    string
+		header http.Header
+		body   string
+		items  int
+		next   string
+		total  int
+	}{
+		{name: "link", p: LinkHeader{}, url: "https://h/x?page=1",
+			header: http.Header{"Link": {`<https://h/x?page=1>; rel="prev", <https://h/x?page=3>; rel="next"`}},
+			body:   `[1, 2]`, items: 2, next: "https://h/x?page=3", total: -1},
+		{name: "link last", p: LinkHeader{}, url: "https://h/x",
+			header: http.Header{"Link": {`<https://h/x?page=1>; rel="first"`}},
+			body:   `[1]`, items: 1, total: -1},
+		{name: "link object", p: LinkHeader{}, url: "https://h/x",
+			body: `{"id": 1}`, items: 1, total: -1},
+		{name: "cursor url", p: Cursor{"values", "next", ""}, url: "https://h/x",
+			body:  `{"values": [1, 2, 3], "next": "https://h/x?page=2", "size": 7}`,
+			items: 3, next: "https://h/x?page=2", total: 7},
+		{name: "cursor last", p: Cursor{"values", "next", ""}, url: "https://h/x",
+			body: `{"values": [1]}`, items: 1, total: -1},
+		{name: "cursor param", p: Cursor{"values", "nextPageStart", "start"},
+			url:   "https://h/x?limit=25",
+			body:  `{"values": [1, 2], "isLastPage": false, "nextPageStart": 25}`,
+			items: 2, next: "https://h/x?limit=25&start=25", total: -1},
+		{name: "cursor param last", p: Cursor{"values", "nextPageStart", "start"},
+			url:  "https://h/x?start=25",
+			body: `{"values": [1], "isLastPage": true}`, items: 1, total: -1},
+		{name: "cursor link", p: Cursor{Items: "check_runs"}, url: "https://h/x",
+			header: http.Header{"Link": {`<https://h/x?page=2>; rel="next"`}},
+			body:   `{"total_count": 3, "check_runs": [1, 2]}`,
+			items:  2, next: "https://h/x?page=2", total: -1},
+		{name: "cursor not a listing", p: Cursor{"values", "next", ""}, url: "https://h/x",
+			body: `{"id": 1}`, items: 1, total: -1},
+		{name: "gitlab", p: GitlabPages{}, url: "https://h/x?per_page=2",
+			header: http.Header{"X-Next-Page": {"2"}, "X-Total": {"5"}},
+			body:   `[1, 2]`, items: 2, next: "https://h/x?page=2&per_page=2", total: 5},
+		{name: "gitlab last", p: GitlabPages{}, url: "https://h/x?page=3",
+			header: http.Header{"X-Next-Page": {""}, "X-Total": {"5"}},
+			body:   `[5]`, items: 1, total: 5},
+		{name: "offset", p: Offset{"offset", "limit"}, url: "https://h/x?limit=2&offset=4",
+			body: `[1, 2]`, items: 2, next: "https://h/x?limit=2&offset=6", total: -1},
+		{name: "offset short", p: Offset{"offset", "limit"}, url: "https://h/x?limit=2&offset=6",
+			body: `[1]`, items: 1, total: -1},
+		{name: "offset empty", p: Offset{"offset", "limit"}, url: "https://h/x?offset=6",
+			body: `[]`, total: -1},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		p, err := tt.p.Page(u, tt.header, []byte(tt.body))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(p.Items) != tt.items || p.Next != tt.next || p.Total != tt.total {
+			t.Errorf("%s: got %d items, next %q, total %d, want %d %q %d", tt.name,
+				len(p.Items), p.Next, p.Total, tt.items, tt.next, tt.total)
+		}
+	}
+}
+
+func TestListPages(t *testing.T) {
+	pages := 0
+	r, _ := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+		pages++
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page < 3 {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+		w.Header().Set("X-Total", "5")
+		fmt.Fprintf(w, `[%d, %d]`, 2*page-1, 2*page)
+	})
+	r.Paginator = GitlabPages{}
+
+	var all []int
+	it := r.List(context.Background(), "/x", nil)
+	if err := it.All(&all); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(all) != "[1 2 3 4 5 6]" || it.Total() != 5 || pages != 3 {
+		t.Errorf("got %v of %d in %d pages", all, it.Total(), pages)
+	}
+
+	// the second page is not fetched
+	pages = 0
+	var some []int
+	if err := r.List(context.Background(), "/x", nil).Max(2).All(&some); err != nil {
+		t.Fatal(err)
+	}
+	if len(some) != 2 || pages != 1 {
+		t.Errorf("got %v in %d pages with Max(2)", some, pages)
+	}
+}
@@ -1,186 +1,239 @@
 package rest
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
+
+	"gotools/util"
 )
 
 type Rest struct {
-	auth    *auth
-	url     string
-	verbose bool
-}
-
-type auth struct {
-	app_id, secret string
-	user, password string
-}
-
-func NewRest(url, user, pass string, verbose bool) *Rest {
-	return &Rest{
-		url: url,
-		auth: &auth{
-			user:     user,
-			password: pass,
-		},
-		verbose: verbose,
-	}
+	auth   Authenticator
+	url    string
+	Retry  Retry
+	Client *http.Client
+	// Trace, when set, logs the requests
+	Trace *Trace
+	// the requests are sent in dry-run mode too
+	noPlan bool
+	// Paginator of the listings, LinkHeader unless set
+	Paginator Paginator
+	// Timeout bounds each attempt of a request, the overall timeout is
+	// the one of the context.
+	Timeout time.Duration
 }
 
-func (c *Rest) request(method string, url string, query url.Values,
-	data interface{}) ([]byte, http.Header, error) {
+// NewRest returns a client of the API at url, auth may be nil for
+// anonymous access. verbose traces the requests.
+func NewRest(url string, auth Authenticator, verbose bool) *Rest {
+	c := &Rest{
+		url:    url,
+		auth:   auth,
+		Retry:  DefaultRetry,
+		Client: DefaultClient,
 
-	b, err := json.Marshal(data)
-	if err != nil {
-		return nil, nil, err
-	}
-	body := strings.NewReader(string(b))
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		log.Panic(err)
+		Paginator: LinkHeader{},
 	}
-	if len(b) != 0 {
-		req.Header.Set("Content-Type", "application/json")
-	}
-	req.Header.Set("PRIVATE-TOKEN", c.auth.password)
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	if c.auth != nil {
-		req.SetBasicAuth(c.auth.user, c.auth.password)
+	if verbose {
+		c.Trace = &Trace{Log: true}
 	}
+	return c
+}
 
-	if query != nil {
-		req.URL.RawQuery = query.Encode()
-	}
+// payload is a request body, kept whole so it can be sent again.
+type payload struct {
+	ctype string
+	b     []byte
+}
 
-	if c.verbose {
-		log.Printf("rest: %s %s <= %s ", method, url, string(b))
+func jsonPayload(data interface{}) (*payload, error) {
+	if data == nil {
+		return nil, nil
 	}
-
-	client := new(http.Client)
-	resp, err := client.Do(req)
+	b, err := json.Marshal(data)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return &payload{ctype: "application/json", b: b}, nil
+}
 
-	if resp.Body == nil {
-		return nil, nil, fmt.Errorf("response body is nil")
+func (p *payload) String() string {
+	if p == nil {
+		return ""
 	}
-	defer resp.Body.Close()
-
-	resBodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	if c.verbose {
-		log.Printf("rest: %d => %s %s %s ", url, resp.StatusCode,
-			resp.Header.Get("Link"), resBodyBytes)
+	if p.ctype != "application/json" {
+		return fmt.Sprintf("<%s, %d bytes>", p.ctype, len(p.b))
 	}
+	return string(p.b)
+}
 
-	if (resp.StatusCode != http.StatusOK) && (resp.StatusCode != http.StatusCreated) {
-		return nil, nil, fmt.Errorf(resp.Status)
-	}
+// cancelBody cancels the context of the attempt once the body is read.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-	return resBodyBytes, resp.Header, nil
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
 }
 
-func (c *Rest) Do(method string, url string, query url.Values,
-	data interface{}) (ret []map[string]interface{}, err error) {
+// send makes the request, with retries, and returns the 2xx response with
+// the body still to read, anything else as an error.
+func (c *Rest) send(ctx context.Context, method string, url string, query url.Values,
+	body *payload) (*http.Response, error) {
 
-	for url != "" {
-		res, h, err := c.request(method, url, query, data)
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body.b)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, r)
+		if err != nil {
+			log.Panic(err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", body.ctype)
+		}
+		if query != nil {
+			req.URL.RawQuery = query.Encode()
+		}
+		if ctx.Value(revalidateKey{}) != nil {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+		return req, nil
+	}
 
-		if len(res) > 0 && res[0] == '[' {
-			e := []map[string]interface{}{}
-			err = json.Unmarshal(res, &e)
+	// not authenticated, that may be a request of its own
+	if util.DryRun && !c.noPlan && method != http.MethodGet && method != http.MethodHead {
+		req, err := newRequest(ctx)
+		if err != nil {
+			return nil, err
+		}
+		step := method + " " + url
+		if query != nil {
+			step += "?" + query.Encode()
+		}
+		util.Mutate(step, nil)
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("{}")),
+			Request:    req,
+		}, nil
+	}
+
+	for failures := 0; ; {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if c.Timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, c.Timeout)
+		}
+		req, err := newRequest(actx)
+		if err == nil && c.auth != nil {
+			err = c.auth.Authenticate(req)
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		var n int
+		if c.Trace != nil {
+			n = c.Trace.request(req, body)
+		}
+		start := time.Now()
+		resp, err := c.Client.Do(req)
+		err = scrubError(err)
+		if c.Trace != nil {
+			c.Trace.response(n, resp, err, time.Since(start))
+		}
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			resp.Body = &cancelBody{resp.Body, cancel}
+			return resp, nil
+		}
+		var errBody []byte
+		if err == nil {
+			errBody, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		wait, retry, limited := c.Retry.next(failures, req, resp, err)
+		if !retry {
+			if c.Trace != nil && c.Trace.Curl {
+				c.Trace.curl(n, req, body)
+			}
 			if err != nil {
 				return nil, err
 			}
-			ret = append(ret, e...)
-			if c.verbose {
-				log.Printf("%s : %s %s", h, e)
-			}
-		} else {
-			e := map[string]interface{}{}
-			err = json.Unmarshal(res, &e)
-			ret = append(ret, e)
-			if c.verbose {
-				log.Printf("%s : %s %s", h, e)
+			e := newAPIError(req, resp, errBody)
+			if d, ok := rateLimited(resp); ok && d > c.Retry.MaxWait {
+				e.Errors = append(e.Errors, fmt.Sprintf("rate limited for another %s",
+					d.Round(time.Second)))
 			}
+			return nil, e
 		}
-
-		url = ""
-		if l, ok := h["Link"]; ok {
-			for _, ll := range l {
-				for _, rel := range strings.Split(ll, ",") {
-					parts := strings.SplitN(rel, ";", 2)
-					if strings.TrimSpace(parts[1]) == `rel="next"` {
-						url = strings.TrimSpace(parts[0])
-						url = url[1 : len(url)-1]
-					}
-				}
-			}
+		if !limited {
+			failures++
+		}
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+		}
+		log.Printf("rest: %s %s: %s, retrying in %s", method, scrubURL(req.URL), reason,
+			wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
-
-	return ret, err
 }
 
-func (c *Rest) execute(method string, url string, query url.Values,
-	data interface{}) (map[string]interface{}, error) {
-
-	res, _, err := c.request(method, url, query, data)
+func (c *Rest) request(ctx context.Context, method string, url string, query url.Values,
+	data interface{}) ([]byte, http.Header, error) {
 
-	var result map[string]interface{}
-	err = json.Unmarshal(res, &result)
+	body, err := jsonPayload(data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return result, nil
+	return c.read(c.send(ctx, method, url, query, body))
 }
 
-func (c *Rest) executeAll(method string, url string, query url.Values,
-	data interface{}) (interface{}, error) {
-
-	result, err := c.execute(method, url, query, data)
+func (c *Rest) read(resp *http.Response, err error) ([]byte, http.Header, error) {
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	next, ok := result["next"]
-	for ok {
-		url := next.(string)
-		nr, err := c.execute(method, url, nil, data)
-		if err != nil {
-			return nil, err
-		}
-		values := result["values"].([]interface{})
-		result["values"] = append(values, nr["values"].([]interface{}))
-		next, ok = nr["next"]
+	defer resp.Body.Close()
+	resBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
 	}
-	return result["values"], nil
+	return resBodyBytes, resp.Header, nil
 }
 
-func (c *Rest) Get(path string, query url.Values, data interface{}) (interface{}, error) {
-	return c.executeAll("GET", c.url+path, query, nil)
-}
+// Do returns the items of a listing, or the response as the only item when
+// it is not one.
+func (c *Rest) Do(ctx context.Context, method string, url string, query url.Values,
+	data interface{}) (ret []map[string]interface{}, err error) {
 
-func (c *Rest) Post(path string, data interface{}) (interface{}, error) {
-	result, err := c.execute("POST", c.url+path, nil, data)
-	if err != nil {
-		return nil, err
+	if method != http.MethodGet {
+		var r map[string]interface{}
+		err = c.Call(ctx, method, url, query, data, &r)
+		return []map[string]interface{}{r}, err
 	}
-	if values, ok := result["values"]; ok {
-		return values, nil
-	}
-	return result, nil
+	ret = []map[string]interface{}{}
+	err = c.List(ctx, url, query).All(&ret)
+	return ret, err
 }
@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retry says how failed requests are retried. Connection errors and 5xx
+// responses are retried with exponential backoff and jitter, rate limited
+// requests wait for the reset the server asks for.
+type Retry struct {
+	// retries of failed attempts, the waits for a rate limit reset don't
+	// count
+	Max int
+	// the first backoff, doubled on every retry up to Cap
+	Base time.Duration
+	Cap  time.Duration
+	// the longest wait for Retry-After or a rate limit reset, the request
+	// fails instead of waiting longer
+	MaxWait time.Duration
+}
+
+var DefaultRetry = Retry{
+	Max:     3,
+	Base:    500 * time.Millisecond,
+	Cap:     30 * time.Second,
+	MaxWait: 5 * time.Minute,
+}
+
+// idempotent requests can be repeated whatever happened to the previous
+// attempt, the others only when it surely was not processed.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// refused is a connection error before anything was sent.
+func refused(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// rateLimited returns how long to wait when resp is a rate limit or
+// Retry-After response.
+func rateLimited(resp *http.Response) (time.Duration, bool) {
+	h := resp.Header
+	if s := h.Get("Retry-After"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			return time.Duration(n) * time.Second, true
+		}
+		if t, err := http.ParseTime(s); err == nil {
+			return time.Until(t), true
+		}
+	}
+	if resp.StatusCode != http.StatusForbidden &&
+		resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	remaining := h.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		remaining = h.Get("RateLimit-Remaining")
+	}
+	if remaining != "0" && resp.StatusCode != http.StatusTooManyRequests {
+		// a plain 403
+		return 0, false
+	}
+	for _, k := range []string{"X-RateLimit-Reset", "RateLimit-Reset"} {
+		n, err := strconv.ParseInt(h.Get(k), 10, 64)
+		if err != nil {
+			continue
+		}
+		// GitHub and GitLab send the epoch time, the IETF draft seconds
+		if n > 1e9 {
+			return time.Until(time.Unix(n, 0)) + time.Second, true
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	return 0, resp.StatusCode == http.StatusTooManyRequests
+}
+
+func (r *Retry) backoff(attempt int) time.Duration {
+	d := r.Base << uint(attempt)
+	if d <= 0 || d > r.Cap {
+		d = r.Cap
+	}
+	// full jitter over the upper half
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// next returns how long to wait before retrying req, false when it is not
+// to be retried. resp and err are the outcome of the attempt, failures the
+// failed attempts retried so far. limited is true for a wait that the
+// server asked for, which is bounded by MaxWait and the context only and
+// doesn't count as a failure.
+func (r *Retry) next(failures int, req *http.Request, resp *http.Response,
+	err error) (wait time.Duration, retry, limited bool) {
+
+	if err == nil {
+		if d, ok := rateLimited(resp); ok && d > 0 {
+			return d, d <= r.MaxWait, true
+		}
+	}
+	if failures >= r.Max {
+		return 0, false, false
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotRecorded) {
+			return 0, false, false
+		}
+		if idempotent(req) || refused(err) {
+			return r.backoff(failures), true, false
+		}
+		return 0, false, false
+	}
+	// a 429 that doesn't say until when
+	if _, ok := rateLimited(resp); ok {
+		return r.backoff(failures), true, false
+	}
+	if resp.StatusCode >= 500 && idempotent(req) {
+		return r.backoff(failures), true, false
+	}
+	return 0, false, false
+}
@@ -0,0 +1,124 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testRest returns a client of a server running h, without retries.
+func testRest(t *testing.T, h http.HandlerFunc) (*Rest, *httptest.Server) {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	r := NewRest(srv.URL, nil, false)
+	r.Client = &http.Client{}
+	r.Retry = Retry{Base: time.Millisecond, Cap: time.Millisecond, MaxWait: time.Minute}
+	return r, srv
+}
+
+func TestRetryNext(t *testing.T) {
+	r := Retry{Max: 2, Base: time.Second, Cap: time.Minute, MaxWait: time.Minute}
+	dial := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	reset := errors.New("connection reset by peer")
+	inAnHour := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name     string
+		method   string
+		key      string
+		failures int
+		err      error
+		status   int
+		header   http.Header
+		retry    bool
+		limited  bool
+		wait     time.Duration
+	}{
+		{name: "GET reset", method: "GET", err: reset, retry: true},
+		{name: "POST reset", method: "POST", err: reset},
+		{name: "POST refused", method: "POST", err: dial, retry: true},
+		{name: "POST with key", method: "POST", key: "k1", err: reset, retry: true},
+		{name: "not recorded", method: "GET", err: fmt.Errorf("x: %w", ErrNotRecorded)},
+		{name: "GET 503", method: "GET", status: 503, retry: true},
+		{name: "PUT 502", method: "PUT", status: 502, retry: true},
+		{name: "POST 503", method: "POST", status: 503},
+		{name: "GET 404", method: "GET", status: 404},
+		{name: "plain 403", method: "GET", status: 403},
+		{name: "out of retries", method: "GET", failures: 2, status: 503},
+		{name: "429 without reset", method: "POST", status: 429, retry: true},
+		{name: "429 without reset out of retries", method: "GET", failures: 2, status: 429},
+		{name: "Retry-After", method: "POST", failures: 2, status: 503,
+			header: http.Header{"Retry-After": {"7"}}, retry: true, limited: true, wait: 7 * time.Second},
+		{name: "Retry-After over MaxWait", method: "GET", status: 429,
+			header: http.Header{"Retry-After": {"3600"}}, limited: true},
+		{name: "rate limit reset", method: "GET", failures: 2, status: 403,
+			header: http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"30"}},
+			retry:  true, limited: true, wait: 30 * time.Second},
+		{name: "rate limit reset over MaxWait", method: "GET", status: 403,
+			header:  http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {inAnHour}},
+			limited: true},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "https://api.example.com/x", nil)
+		if tt.key != "" {
+			req.Header.Set("Idempotency-Key", tt.key)
+		}
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for k, v := range tt.header {
+				resp.Header[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+		wait, retry, limited := r.next(tt.failures, req, resp, tt.err)
+		if retry != tt.retry || limited != tt.limited {
+			t.Errorf("%s: retry %v limited %v, want %v %v", tt.name,
+				retry, limited, tt.retry, tt.limited)
+		}
+		if tt.wait != 0 && wait != tt.wait {
+			t.Errorf("%s: wait %s, want %s", tt.name, wait, tt.wait)
+		}
+		if retry && !limited && (wait < r.Base/2 || wait > r.Cap) {
+			t.Errorf("%s: backoff %s", tt.name, wait)
+		}
+	}
+}
+
+func TestRetryServer(t *testing.T) {
+	n := 0
+	r, _ := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+		n++
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprint(w, `{"ok": true}`)
+		}
+	})
+	// the rate limit wait doesn't use up the only retry
+	r.Retry.Max = 1
+	var out struct{ Ok bool }
+	if err := r.Call(context.Background(), "GET", "/x", nil, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Ok || n != 3 {
+		t.Errorf("got %+v after %d requests", out, n)
+	}
+
+	n = 0
+	r.Retry.Max = 0
+	err := r.Call(context.Background(), "GET", "/x", nil, nil, nil)
+	var aerr *APIError
+	if !errors.As(err, &aerr) || aerr.StatusCode != http.StatusBadGateway || n != 1 {
+		t.Errorf("got %v after %d requests", err, n)
+	}
+}
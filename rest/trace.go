@@ -0,0 +1,184 @@
+package rest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Trace logs the requests of a client with the secrets redacted. Log
+// prints the method, url, status, latency and headers of every attempt,
+// Bodies is a directory where the request and response bodies are saved and
+// Curl prints a curl command reproducing the requests that failed.
+type Trace struct {
+	Log    bool
+	Bodies string
+	Curl   bool
+
+	mu sync.Mutex
+	n  int
+}
+
+// redact hides the value of a sensitive header, keeping the scheme of an
+// Authorization header.
+func redact(k, v, with string) string {
+	if !isSensitive(k) {
+		return v
+	}
+	if i := strings.IndexByte(v, ' '); i > 0 && strings.EqualFold(k, "Authorization") {
+		return v[:i+1] + with
+	}
+	return with
+}
+
+func (t *Trace) headers(n int, dir string, h http.Header) {
+	keys := []string{}
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			log.Printf("rest: #%d %s %s: %s", n, dir, k, redact(k, v, scrubbed))
+		}
+	}
+}
+
+func bodyFile(dir string, n int, kind, ctype string) string {
+	ext := ".bin"
+	if strings.Contains(ctype, "json") {
+		ext = ".json"
+	} else if strings.HasPrefix(ctype, "text/") {
+		ext = ".txt"
+	}
+	return filepath.Join(dir, fmt.Sprintf("%04d-%s%s", n, kind, ext))
+}
+
+// save writes a body, JSON ones with the secrets scrubbed.
+func (t *Trace) save(fn string, b []byte) {
+	if strings.HasSuffix(fn, ".json") {
+		b = []byte(scrubBody(b))
+	}
+	err := os.MkdirAll(filepath.Dir(fn), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(fn, b, 0600)
+	}
+	if err != nil {
+		log.Printf("rest: %s", err)
+	}
+}
+
+// scrubError hides the secrets in the url of a transport error, which is
+// logged and returned as is otherwise.
+func scrubError(err error) error {
+	var uerr *url.Error
+	if !errors.As(err, &uerr) {
+		return err
+	}
+	u, perr := url.Parse(uerr.URL)
+	if perr != nil {
+		return err
+	}
+	return &url.Error{Op: uerr.Op, URL: scrubURL(u), Err: uerr.Err}
+}
+
+// request starts tracing an attempt and returns its number.
+func (t *Trace) request(req *http.Request, body *payload) int {
+	t.mu.Lock()
+	t.n++
+	n := t.n
+	t.mu.Unlock()
+
+	if t.Log {
+		log.Printf("rest: #%d %s %s", n, req.Method, scrubURL(req.URL))
+		t.headers(n, ">", req.Header)
+	}
+	if t.Bodies != "" && body != nil {
+		t.save(bodyFile(t.Bodies, n, "request", body.ctype), body.b)
+	}
+	return n
+}
+
+// response logs the outcome of attempt n, the body is saved as it is read.
+func (t *Trace) response(n int, resp *http.Response, err error, d time.Duration) {
+	d = d.Round(time.Millisecond)
+	if err != nil {
+		if t.Log {
+			log.Printf("rest: #%d failed after %s: %s", n, d, err)
+		}
+		return
+	}
+	if t.Log {
+		log.Printf("rest: #%d %s in %s", n, resp.Status, d)
+		t.headers(n, "<", resp.Header)
+	}
+	if t.Bodies != "" {
+		fn := bodyFile(t.Bodies, n, "response", resp.Header.Get("Content-Type"))
+		resp.Body = &traceBody{ReadCloser: resp.Body, trace: t, fn: fn}
+	}
+}
+
+// traceBody saves the body once closed.
+type traceBody struct {
+	io.ReadCloser
+	trace *Trace
+	fn    string
+	buf   bytes.Buffer
+}
+
+func (b *traceBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *traceBody) Close() error {
+	b.trace.save(b.fn, b.buf.Bytes())
+	return b.ReadCloser.Close()
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// curl logs a command repeating request n, with the credentials taken from
+// $TOKEN.
+func (t *Trace) curl(n int, req *http.Request, body *payload) {
+	cmd := []string{"curl", "-X", req.Method, quote(scrubURL(req.URL))}
+	keys := []string{}
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range req.Header[k] {
+			if isSensitive(k) {
+				cmd = append(cmd, "-H", `"`+k+": "+redact(k, v, "$TOKEN")+`"`)
+			} else {
+				cmd = append(cmd, "-H", quote(k+": "+v))
+			}
+		}
+	}
+	switch {
+	case body == nil:
+	case t.Bodies != "":
+		cmd = append(cmd, "--data-binary",
+			"@"+quote(bodyFile(t.Bodies, n, "request", body.ctype)))
+	case body.ctype == "application/json":
+		cmd = append(cmd, "--data-binary", quote(scrubBody(body.b)))
+	default:
+		cmd = append(cmd, "--data-binary", "@BODY", "# "+body.String())
+	}
+	log.Printf("rest: #%d %s", n, strings.Join(cmd, " "))
+}
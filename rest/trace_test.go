@@ -0,0 +1,100 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// traced returns what the requests of f logged.
+func traced(f func()) string {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	f()
+	return b.String()
+}
+
+func TestTraceScrubs(t *testing.T) {
+	secrets := []string{"b3arer", "pr1vate", "qu3ry", "c00kie", "r3fresh"}
+	r, srv := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Set-Cookie", "session=c00kie")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "401 Unauthorized", "refresh_token": "r3fresh"}`))
+	})
+	dir := t.TempDir()
+	r.Trace = &Trace{Log: true, Curl: true, Bodies: dir}
+	query := url.Values{"access_token": {"qu3ry"}}
+	body := map[string]string{"password": "pr1vate", "title": "x"}
+
+	tests := []struct {
+		name string
+		auth Authenticator
+		want []string
+	}{
+		{"bearer", BearerToken("b3arer"),
+			[]string{"Authorization: Bearer REDACTED", `"Authorization: Bearer $TOKEN"`}},
+		{"private token", &HeaderToken{Header: "Private-Token", Token: "pr1vate"},
+			[]string{"Private-Token: REDACTED", `"Private-Token: $TOKEN"`}},
+		{"basic", &BasicAuth{User: "me", Password: "b3arer"},
+			[]string{"Authorization: Basic REDACTED"}},
+	}
+	for _, tt := range tests {
+		r.auth = tt.auth
+		var err error
+		out := traced(func() {
+			err = r.Call(context.Background(), "POST", "/x", query, body, nil)
+		})
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		out += err.Error()
+		tt.want = append(tt.want, "access_token=REDACTED", "curl -X POST")
+		for _, s := range tt.want {
+			if !strings.Contains(out, s) {
+				t.Errorf("%s: no %s in\n%s", tt.name, s, out)
+			}
+		}
+		for _, s := range secrets {
+			if strings.Contains(out, s) {
+				t.Errorf("%s: %s in\n%s", tt.name, s, out)
+			}
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) == 0 {
+		t.Error("no bodies saved")
+	}
+	for _, fn := range files {
+		b, _ := ioutil.ReadFile(fn)
+		for _, s := range secrets {
+			if strings.Contains(string(b), s) {
+				t.Errorf("%s in %s: %s", s, fn, b)
+			}
+		}
+	}
+
+	// the url of a transport error is scrubbed too
+	srv.Close()
+	var err error
+	out := traced(func() {
+		err = r.Call(context.Background(), "GET", "/x", query, nil, nil)
+	})
+	if err == nil {
+		t.Fatal("no error from a closed server")
+	}
+	out += err.Error()
+	if strings.Contains(out, "qu3ry") || !strings.Contains(out, "access_token=REDACTED") {
+		t.Errorf("transport error not scrubbed:\n%s", out)
+	}
+}
@@ -0,0 +1,61 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// TLS is the optional client side TLS setup, PEM file names.
+type TLS struct {
+	CA   string `json:"ca,omitempty" help:"PEM bundle of CAs trusted on top of the system ones"`
+	Cert string `json:"cert,omitempty" help:"client certificate PEM file" requires:"tls.key"`
+	Key  string `json:"key,omitempty" help:"client certificate key PEM file" requires:"tls.cert"`
+}
+
+// NewTransport returns a transport meant to be shared by the clients of a
+// few API hosts: keep-alive, the proxy from the environment and t, which
+// may be nil.
+func NewTransport(t *TLS) (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConnsPerHost = 8
+	tr.IdleConnTimeout = 90 * time.Second
+	tr.TLSHandshakeTimeout = 10 * time.Second
+	if t == nil || (t.CA == "" && t.Cert == "") {
+		return tr, nil
+	}
+
+	conf := &tls.Config{}
+	if t.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no PEM certificates", t.CA)
+		}
+		conf.RootCAs = pool
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	tr.TLSClientConfig = conf
+	return tr, nil
+}
+
+var defaultTransport, _ = NewTransport(nil)
+
+// DefaultClient is shared by all the Rest clients that don't set their own
+// so they reuse the connections.
+var DefaultClient = &http.Client{Transport: defaultTransport}
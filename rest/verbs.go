@@ -0,0 +1,128 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+func (c *Rest) Put(ctx context.Context, path string, data interface{}) (interface{}, error) {
+	var result interface{}
+	err := c.Call(ctx, http.MethodPut, path, nil, data, &result)
+	return result, err
+}
+
+func (c *Rest) Patch(ctx context.Context, path string, data interface{}) (interface{}, error) {
+	var result interface{}
+	err := c.Call(ctx, http.MethodPatch, path, nil, data, &result)
+	return result, err
+}
+
+func (c *Rest) Delete(ctx context.Context, path string) error {
+	return c.Call(ctx, http.MethodDelete, path, nil, nil, nil)
+}
+
+// Head returns the headers of path, like its ETag or Content-Length.
+func (c *Rest) Head(ctx context.Context, path string, query url.Values) (http.Header, error) {
+	resp, err := c.send(ctx, http.MethodHead, c.resolve(path), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+func (c *Rest) upload(ctx context.Context, method, path string, body *payload,
+	out interface{}) error {
+
+	res, _, err := c.read(c.send(ctx, method, c.resolve(path), nil, body))
+	if err != nil || out == nil || len(res) == 0 {
+		return err
+	}
+	return json.Unmarshal(res, out)
+}
+
+// Upload sends the content of r as is and decodes the JSON response into
+// out, if not nil.
+func (c *Rest) Upload(ctx context.Context, method, path, contentType string,
+	r io.Reader, out interface{}) error {
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.upload(ctx, method, path, &payload{ctype: contentType, b: b}, out)
+}
+
+// File is a file part of a multipart/form-data upload.
+type File struct {
+	Field, Name string
+	Content     io.Reader
+}
+
+// UploadForm sends the fields and files as multipart/form-data, the way
+// files get attached to merge requests and releases, and decodes the JSON
+// response into out, if not nil.
+func (c *Rest) UploadForm(ctx context.Context, method, path string,
+	fields url.Values, files []File, out interface{}) error {
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for k, vs := range fields {
+		for _, v := range vs {
+			if err := w.WriteField(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range files {
+		fw, err := w.CreateFormFile(f.Field, f.Name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(fw, f.Content); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.upload(ctx, method, path,
+		&payload{ctype: w.FormDataContentType(), b: b.Bytes()}, out)
+}
+
+// Download streams path into w calling progress, if not nil, as it goes
+// with the bytes written so far and the total, -1 when unknown.
+func (c *Rest) Download(ctx context.Context, path string, query url.Values,
+	w io.Writer, progress func(done, total int64)) (int64, error) {
+
+	resp, err := c.send(ctx, http.MethodGet, c.resolve(path), query, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var r io.Reader = resp.Body
+	if progress != nil {
+		r = &progressReader{r: resp.Body, total: resp.ContentLength, f: progress}
+	}
+	return io.Copy(w, r)
+}
+
+type progressReader struct {
+	r     io.Reader
+	done  int64
+	total int64
+	f     func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	p.f(p.done, p.total)
+	return n, err
+}
@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerbs(t *testing.T) {
+	var got []string
+	r, _ := testRest(t, func(w http.ResponseWriter, req *http.Request) {
+		ctype := req.Header.Get("Content-Type")
+		body := ""
+		if strings.HasPrefix(ctype, "multipart/form-data") {
+			req.ParseMultipartForm(1 << 20)
+			f, h, _ := req.FormFile("file")
+			b, _ := ioutil.ReadAll(f)
+			body = fmt.Sprintf("title=%s %s=%s", req.FormValue("title"), h.Filename, b)
+		} else {
+			b, _ := ioutil.ReadAll(req.Body)
+			body = string(b)
+		}
+		got = append(got, strings.TrimSpace(req.Method+" "+req.URL.Path+" "+body))
+		w.Header().Set("ETag", `"e1"`)
+		if req.Method != "HEAD" && req.Method != "DELETE" {
+			fmt.Fprint(w, `{"ok": true}`)
+		}
+	})
+	ctx := context.Background()
+	in := map[string]int{"n": 1}
+
+	if res, err := r.Put(ctx, "/put", in); err != nil || fmt.Sprint(res) != "map[ok:true]" {
+		t.Errorf("put: %v %v", res, err)
+	}
+	if res, err := r.Patch(ctx, "/patch", in); err != nil || fmt.Sprint(res) != "map[ok:true]" {
+		t.Errorf("patch: %v %v", res, err)
+	}
+	if err := r.Delete(ctx, "/delete"); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	if h, err := r.Head(ctx, "/head", nil); err != nil || h.Get("ETag") != `"e1"` {
+		t.Errorf("head: %v %v", h, err)
+	}
+	if err := r.Upload(ctx, "POST", "/upload", "text/plain",
+		strings.NewReader("raw"), nil); err != nil {
+		t.Errorf("upload: %v", err)
+	}
+	var out struct{ Ok bool }
+	err := r.UploadForm(ctx, "POST", "/form", url.Values{"title": {"log"}},
+		[]File{{Field: "file", Name: "a.txt", Content: strings.NewReader("abc")}}, &out)
+	if err != nil || !out.Ok {
+		t.Errorf("upload form: %v %v", out, err)
+	}
+	var b bytes.Buffer
+	var done, total int64
+	n, err := r.Download(ctx, "/download", nil, &b, func(d, t int64) { done, total = d, t })
+	if err != nil || n != 12 || b.String() != `{"ok": true}` || done != 12 || total != 12 {
+		t.Errorf("download: %d %q %d/%d %v", n, b.String(), done, total, err)
+	}
+
+	want := []string{`PUT /put {"n":1}`, `PATCH /patch {"n":1}`, "DELETE /delete",
+		"HEAD /head", "POST /upload raw", "POST /form title=log a.txt=abc", "GET /download"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
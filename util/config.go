@@ -0,0 +1,127 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Configuration layers, lowest precedence first.
+const (
+	FromDefault = "default"
+	FromFile    = "file"
+	FromGit     = "git"
+	FromSecret  = "secret"
+	FromEnv     = "env"
+	FromFlag    = "flag"
+)
+
+type Origin struct {
+	Layer string
+	Where string
+}
+
+func (o Origin) String() string {
+	if o.Where == "" {
+		return o.Layer
+	}
+	return o.Layer + " " + o.Where
+}
+
+var origins = map[string]Origin{}
+var secrets = map[string]bool{}
+
+// the flags of the fields of the tool's arguments, the ones its config
+// files set
+var fieldFlags = map[string]bool{}
+
+func setOrigin(name, layer, where string) {
+	origins[name] = Origin{Layer: layer, Where: where}
+}
+
+// OriginOf reports which configuration layer supplied the flag value.
+func OriginOf(name string) Origin {
+	return origins[name]
+}
+
+func IsSecret(name string) bool {
+	return secrets[name]
+}
+
+func EnvName(prefix, name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").
+		Replace(prefix + "_" + name))
+}
+
+func LoadEnvFlags(s string) {
+	f := func(f *flag.Flag) {
+		key := EnvName(s, f.Name)
+		if val, ok := os.LookupEnv(key); ok {
+			flag.Set(f.Name, val)
+			setOrigin(f.Name, FromEnv, key)
+		}
+	}
+	flag.VisitAll(f)
+}
+
+// parseInterspersed is flag.Parse that also takes the flags following
+// the positional arguments, as in "pr merge --verbose".
+func parseInterspersed() {
+	flag.Parse()
+	pos := []string{}
+	for flag.NArg() > 0 {
+		args := flag.Args()
+		if args[0] == "--" {
+			pos = append(pos, args[1:]...)
+			break
+		}
+		pos = append(pos, args[0])
+		flag.CommandLine.Parse(args[1:])
+	}
+	flag.CommandLine.Parse(append([]string{"--"}, pos...))
+}
+
+// cmdlineFlags returns the names of the flags given on the command line,
+// flag.Visit can't tell those from the ones set by the other layers.
+func cmdlineFlags() (names []string) {
+	for _, a := range os.Args[1:] {
+		if a == "--" {
+			break
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		n := strings.SplitN(strings.TrimLeft(a, "-"), "=", 2)[0]
+		if flag.Lookup(n) != nil {
+			names = append(names, n)
+		}
+	}
+	return
+}
+
+func mask(val string) string {
+	if val == "" {
+		return val
+	}
+	return "********"
+}
+
+func ShowConfig(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tVALUE\tSOURCE\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		o, ok := origins[f.Name]
+		if !ok {
+			return
+		}
+		val := f.Value.String()
+		if secrets[f.Name] {
+			val = mask(val)
+		}
+		fmt.Fprintf(tw, "%s\t%q\t%s\n", f.Name, val, o)
+	})
+	tw.Flush()
+}
@@ -0,0 +1,312 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+var ConfigExts = []string{"", ".json", ".yaml", ".yml", ".toml"}
+
+func LinePosFromOff(r io.Reader, off int64) (lineno int, pos int64, err error) {
+	br := bufio.NewReader(r)
+	lineno = 1
+	pos = off - 1
+
+	var line []byte
+	var trunc bool
+
+	for {
+		line, trunc, err = br.ReadLine()
+		if err != nil {
+			return
+		}
+
+		if int64(len(line)) > pos {
+			return
+		}
+
+		pos -= int64(len(line) + 1)
+
+		if !trunc {
+			lineno += 1
+		}
+	}
+}
+
+var tomlLine = regexp.MustCompile(`(?m)^\s*(\[[\w."-]+\]|[\w"-]+\s*=)`)
+
+// ConfigFormat tells json, yaml or toml from the file extension or, for
+// files without one, from the content.
+func ConfigFormat(fn string, b []byte) string {
+	switch filepath.Ext(fn) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	t := bytes.TrimSpace(b)
+	if len(t) > 0 && (t[0] == '{' || t[0] == '[') {
+		return "json"
+	}
+	if tomlLine.Match(t) {
+		return "toml"
+	}
+	return "yaml"
+}
+
+var yamlLine = regexp.MustCompile(`line (\d+)`)
+var tomlPrefix = regexp.MustCompile(`^toml: line \d+( \(last key "[^"]*"\))?: `)
+
+func posError(fn string, b []byte, off int64, err error) error {
+	line, col, _ := LinePosFromOff(bytes.NewReader(b), off)
+	return fmt.Errorf("%s:%d:%d: %s", fn, line, col+1, err)
+}
+
+// DecodeConfig parses a config file into a generic map, errors carry the
+// file:line:column of the problem.
+func DecodeConfig(fn string, b []byte) (m map[string]interface{}, err error) {
+	switch ConfigFormat(fn, b) {
+	case "json":
+		err = json.Unmarshal(b, &m)
+		var serr *json.SyntaxError
+		var terr *json.UnmarshalTypeError
+		if errors.As(err, &serr) {
+			return nil, posError(fn, b, serr.Offset, err)
+		} else if errors.As(err, &terr) {
+			return nil, posError(fn, b, terr.Offset, err)
+		}
+	case "yaml":
+		var y interface{}
+		if err = yaml.Unmarshal(b, &y); err != nil {
+			msg := strings.TrimPrefix(err.Error(), "yaml: ")
+			if l := yamlLine.FindStringSubmatch(msg); l != nil {
+				msg = strings.Replace(msg, l[0]+": ", "", 1)
+				return nil, fmt.Errorf("%s:%s: %s", fn, l[1], msg)
+			}
+			return nil, fmt.Errorf("%s: %s", fn, msg)
+		}
+		if y == nil {
+			return map[string]interface{}{}, nil
+		}
+		var ok bool
+		if m, ok = stringKeys(y).(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%s:1:1: expected a mapping", fn)
+		}
+	case "toml":
+		_, err = toml.Decode(string(b), &m)
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			line := perr.Position.Line
+			start := 0
+			for i := 1; i < line && start < len(b); i++ {
+				start += bytes.IndexByte(b[start:], '\n') + 1
+			}
+			col := perr.Position.Start - start + 1
+			if col < 1 {
+				col = 1
+			}
+			msg := tomlPrefix.ReplaceAllString(perr.Error(), "")
+			return nil, fmt.Errorf("%s:%d:%d: %s", fn, line, col, msg)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return m, nil
+}
+
+// KeyPositions tells where the keys of a config file are, as line:column
+// by dotted key like the flag names, for the errors in their values.
+func KeyPositions(fn string, b []byte) map[string]string {
+	switch ConfigFormat(fn, b) {
+	case "json":
+		return jsonPositions(b)
+	case "toml":
+		return tomlPositions(b)
+	}
+	return yamlPositions(b)
+}
+
+func lineCol(b []byte, off int) string {
+	if off > len(b) {
+		off = len(b)
+	}
+	line := bytes.Count(b[:off], []byte("\n")) + 1
+	col := off - (bytes.LastIndexByte(b[:off], '\n') + 1) + 1
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+func jsonPositions(b []byte) map[string]string {
+	pos := map[string]string{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'):
+			for d.More() {
+				t, err := d.Token()
+				if err != nil {
+					return err
+				}
+				k, _ := t.(string)
+				// the offset is past the quoted key
+				pos[prefix+k] = lineCol(b, int(d.InputOffset())-len(k)-2)
+				if err := walk(prefix + k + "."); err != nil {
+					return err
+				}
+			}
+			_, err = d.Token()
+		case json.Delim('['):
+			for d.More() {
+				if err := walk(prefix); err != nil {
+					return err
+				}
+			}
+			_, err = d.Token()
+		}
+		return err
+	}
+	walk("")
+	return pos
+}
+
+var yamlKey = regexp.MustCompile(`^( *)("[^"]*"|'[^']*'|[^\s#'"-][^:#]*?) *:( |$)`)
+
+// yamlPositions finds the keys of the block mappings by their indentation.
+func yamlPositions(b []byte) map[string]string {
+	pos := map[string]string{}
+	type key struct {
+		indent int
+		name   string
+	}
+	stack := []key{}
+	for i, line := range strings.Split(string(b), "\n") {
+		m := yamlKey.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		indent, name := len(m[1]), strings.Trim(m[2], `"'`)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, key{indent, name})
+		names := []string{}
+		for _, k := range stack {
+			names = append(names, k.name)
+		}
+		pos[strings.Join(names, ".")] = fmt.Sprintf("%d:%d", i+1, indent+1)
+	}
+	return pos
+}
+
+var tomlTable = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]`)
+var tomlKey = regexp.MustCompile(`^(\s*)([\w".-]+)\s*=`)
+
+func tomlPositions(b []byte) map[string]string {
+	pos := map[string]string{}
+	prefix := ""
+	for i, line := range strings.Split(string(b), "\n") {
+		if m := tomlTable.FindStringSubmatch(line); m != nil {
+			prefix = strings.ReplaceAll(m[1], `"`, "") + "."
+			pos[strings.TrimSuffix(prefix, ".")] = fmt.Sprintf("%d:1", i+1)
+		} else if m := tomlKey.FindStringSubmatch(line); m != nil {
+			k := prefix + strings.ReplaceAll(m[2], `"`, "")
+			pos[k] = fmt.Sprintf("%d:%d", i+1, len(m[1])+1)
+		}
+	}
+	return pos
+}
+
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, x := range v {
+			m[fmt.Sprint(k)] = stringKeys(x)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = stringKeys(v[i])
+		}
+	}
+	return v
+}
+
+// UnknownKeys lists the keys of m that don't match a field of the struct
+// type t, nested keys are dotted.
+func UnknownKeys(m map[string]interface{}, t reflect.Type) []string {
+	r := unknownKeys(m, t, "")
+	sort.Strings(r)
+	return r
+}
+
+func knownFields(t reflect.Type) map[string]reflect.Type {
+	known := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for n, ft := range knownFields(f.Type) {
+				known[n] = ft
+			}
+			continue
+		}
+		name := f.Name
+		if n := strings.Split(tag, ",")[0]; n != "" {
+			name = n
+		}
+		known[name] = f.Type
+	}
+	return known
+}
+
+func unknownKeys(m map[string]interface{}, t reflect.Type, prefix string) (r []string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	known := knownFields(t)
+	for k, v := range m {
+		ft, ok := known[k]
+		if !ok {
+			// encoding/json matches field names case-insensitively
+			for n, t := range known {
+				if strings.EqualFold(n, k) {
+					ft, ok = t, true
+				}
+			}
+		}
+		if !ok {
+			r = append(r, prefix+k)
+			continue
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			r = append(r, unknownKeys(sub, ft, prefix+k+".")...)
+		}
+	}
+	return
+}
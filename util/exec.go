@@ -0,0 +1,150 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Cmd describes a command for an Executor. Stdout, when set, gets a copy
+// of the output as it is produced, Stderr likewise.
+type Cmd struct {
+	Name   string
+	Args   []string
+	Dir    string
+	Env    []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (c *Cmd) String() string {
+	return strings.TrimSpace(c.Name + " " + strings.Join(c.Args, " "))
+}
+
+type Executor interface {
+	Run(ctx context.Context, c *Cmd) (string, error)
+}
+
+// Exec runs every command issued through util, swap it for a FakeExecutor
+// to run the tools without touching the system.
+var Exec Executor = &OsExecutor{}
+
+// ExecError is returned for a command that failed to start or exited
+// with a non-zero status.
+type ExecError struct {
+	Cmd      string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+const stderrTail = 10
+
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ExecError) Error() string {
+	s := fmt.Sprintf("%s: %s", e.Cmd, e.Err)
+	if e.ExitCode > 0 {
+		s = fmt.Sprintf("%s: exit status %d", e.Cmd, e.ExitCode)
+	}
+	if e.Stderr != "" {
+		s += "\n" + tail(e.Stderr, stderrTail)
+	}
+	return s
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+type OsExecutor struct{}
+
+func (x *OsExecutor) Run(ctx context.Context, c *Cmd) (string, error) {
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	if c.Env != nil {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	if c.Stdout != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, c.Stdout)
+	}
+	cmd.Stderr = &stderr
+	if c.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, c.Stderr)
+	}
+
+	err := cmd.Run()
+	out := strings.TrimSpace(stdout.String())
+	if err == nil {
+		return out, nil
+	}
+
+	e := &ExecError{Cmd: c.String(), Stderr: stderr.String(), Err: err}
+	if ctx.Err() != nil {
+		e.Err = ctx.Err()
+	} else if ee, ok := err.(*exec.ExitError); ok {
+		e.ExitCode = ee.ExitCode()
+	}
+	return out, e
+}
+
+// FakeResult is what a FakeExecutor answers for a command line.
+type FakeResult struct {
+	Out      string
+	Stderr   string
+	ExitCode int
+}
+
+// FakeExecutor answers commands from a table keyed by the command line
+// ("git rev-parse --abbrev-ref @{u}") and records what was run. Commands
+// not in the table fail.
+type FakeExecutor struct {
+	Results map[string]FakeResult
+	Calls   []string
+	mu      sync.Mutex
+}
+
+func (x *FakeExecutor) Run(ctx context.Context, c *Cmd) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	line := c.String()
+	x.Calls = append(x.Calls, line)
+	if err := ctx.Err(); err != nil {
+		return "", &ExecError{Cmd: line, Err: err}
+	}
+	r, ok := x.Results[line]
+	if !ok {
+		return "", &ExecError{Cmd: line, Err: errors.New("unexpected command")}
+	}
+	if c.Stdout != nil {
+		io.WriteString(c.Stdout, r.Out)
+	}
+	if r.ExitCode != 0 {
+		return r.Out, &ExecError{Cmd: line, ExitCode: r.ExitCode,
+			Stderr: r.Stderr, Err: fmt.Errorf("exit status %d", r.ExitCode)}
+	}
+	return strings.TrimSpace(r.Out), nil
+}
+
+// Run runs a command through Exec and returns its trimmed output.
+func Run(ctx context.Context, cmd string, arg ...string) (string, error) {
+	return Exec.Run(ctx, &Cmd{Name: cmd, Args: arg})
+}
@@ -0,0 +1,183 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Output is the format results are written to stdout in, set with
+// --output. Everything else, progress and diagnostics, goes to stderr.
+var Output = "text"
+
+var Formats = []string{"text", "json", "yaml", "table"}
+
+// Emit writes the result of a command to stdout. Results are structs or
+// slices of structs, their json tags are the schema for every format. In
+// dry-run mode the plan takes the place of the result.
+func Emit(v interface{}) {
+	if DryRun {
+		return
+	}
+	if err := Write(os.Stdout, Output, v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func Write(w io.Writer, format string, v interface{}) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		var g interface{}
+		Unpack(v, &g)
+		b, err := yaml.Marshal(g)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case "table":
+		return table(w, v)
+	case "text":
+		if s, ok := v.(fmt.Stringer); ok {
+			_, err := fmt.Fprintln(w, s)
+			return err
+		}
+		return text(w, v)
+	}
+	return fmt.Errorf("unknown output format %q, use one of %s",
+		format, strings.Join(Formats, ", "))
+}
+
+type column struct {
+	name  string
+	index int
+}
+
+func columns(t reflect.Type) (c []column) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name := f.Name
+		if n := strings.Split(tag, ",")[0]; n != "" {
+			name = n
+		}
+		c = append(c, column{name: name, index: i})
+	}
+	return
+}
+
+func cell(v reflect.Value) string {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		s := []string{}
+		for i := 0; i < v.Len(); i++ {
+			s = append(s, cell(v.Index(i)))
+		}
+		return strings.Join(s, ",")
+	case reflect.Struct, reflect.Map:
+		b, _ := json.Marshal(v.Interface())
+		return string(b)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// rows turns a struct or a slice of structs into reflect values of the
+// same struct type.
+func rows(v interface{}) (t reflect.Type, r []reflect.Value, err error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		return rv.Type(), []reflect.Value{rv}, nil
+	case reflect.Slice:
+		t = rv.Type().Elem()
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			break
+		}
+		for i := 0; i < rv.Len(); i++ {
+			e := rv.Index(i)
+			for e.Kind() == reflect.Ptr {
+				e = e.Elem()
+			}
+			r = append(r, e)
+		}
+		return t, r, nil
+	}
+	return nil, nil, fmt.Errorf("can't print %T as a table", v)
+}
+
+func table(w io.Writer, v interface{}) error {
+	t, r, err := rows(v)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	cols := columns(t)
+	for i, c := range cols {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, strings.ToUpper(c.name))
+	}
+	fmt.Fprintln(tw)
+	for _, row := range r {
+		for i, c := range cols {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell(row.Field(c.index)))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func text(w io.Writer, v interface{}) error {
+	t, r, err := rows(v)
+	if err != nil {
+		_, err = fmt.Fprintln(w, v)
+		return err
+	}
+	cols := columns(t)
+	for n, row := range r {
+		// one line per Stringer, a blank line between the key: value blocks
+		if s, ok := row.Interface().(fmt.Stringer); ok {
+			fmt.Fprintln(w, s)
+			continue
+		}
+		if n > 0 {
+			fmt.Fprintln(w)
+		}
+		for _, c := range cols {
+			if s := cell(row.Field(c.index)); s != "" {
+				fmt.Fprintf(w, "%s: %s\n", c.name, s)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// DryRun, set with --dry-run, turns every Mutate into a step of the plan
+// printed by ShowPlan instead of running it. Reads still go through so the
+// plan reflects the actual state.
+var DryRun bool
+
+type Step struct {
+	N      int    `json:"n"`
+	Action string `json:"action"`
+}
+
+func (s Step) String() string {
+	return fmt.Sprintf("%d. %s", s.N, s.Action)
+}
+
+var plan []Step
+
+// Mutate runs f, or in dry-run mode records the step instead.
+func Mutate(step string, f func() error) error {
+	if DryRun {
+		plan = append(plan, Step{N: len(plan) + 1, Action: step})
+		return nil
+	}
+	return f()
+}
+
+func Mutatef(f func() error, format string, arg ...interface{}) error {
+	return Mutate(fmt.Sprintf(format, arg...), f)
+}
+
+func Plan() []Step {
+	return plan
+}
+
+// ShowPlan prints the plan in the --output format, meant to be deferred
+// right after GetFlags.
+func ShowPlan() {
+	if !DryRun {
+		return
+	}
+	if len(plan) == 0 {
+		log.Printf("dry run: nothing to do")
+		return
+	}
+	if err := Write(os.Stdout, Output, plan); err != nil {
+		log.Fatal(err)
+	}
+}
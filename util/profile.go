@@ -0,0 +1,274 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Profiles live in ~/.config/gotools:
+//
+//	{
+//	  "current": "work",
+//	  "profiles": {
+//	    "default": {"pr": {"team": "core"}, "jenkins": {"user": "me"}},
+//	    "work": {"inherits": "staging", "jenkins": {"host": "ci.work"}}
+//	  }
+//	}
+//
+// A profile is a section per tool, named like the tool's ~/.<name> file.
+// Every profile inherits from "default", and from the profile named by
+// "inherits" when there is one, the profile's own values taking precedence.
+type Profiles struct {
+	Current  string                            `json:"current,omitempty"`
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+}
+
+const DefaultProfile = "default"
+
+// ProfilesPath is ~/.config/gotools, or the first of its .json, .yaml,
+// .yml or .toml variants that exists.
+func ProfilesPath() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	fn := path.Join(u.HomeDir, ".config", "gotools")
+	if found := FindConfig(fn); found != "" {
+		return found
+	}
+	return fn
+}
+
+func LoadProfiles() (*Profiles, error) {
+	p := &Profiles{Profiles: map[string]map[string]interface{}{}}
+	fn := ProfilesPath()
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m, err := DecodeConfig(fn, b)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range UnknownKeys(m, reflect.TypeOf(p)) {
+		log.Printf("warning: %s: unknown key %s", fn, k)
+	}
+	b, _ = json.Marshal(m)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	if p.Profiles == nil {
+		p.Profiles = map[string]map[string]interface{}{}
+	}
+	return p, nil
+}
+
+// Save writes the profiles back in the format the file is in.
+func (p *Profiles) Save() error {
+	fn := ProfilesPath()
+	old, _ := ioutil.ReadFile(fn)
+
+	var g map[string]interface{}
+	Unpack(p, &g)
+	var b bytes.Buffer
+	var err error
+	switch ConfigFormat(fn, old) {
+	case "yaml":
+		var y []byte
+		y, err = yaml.Marshal(g)
+		b.Write(y)
+	case "toml":
+		err = toml.NewEncoder(&b).Encode(g)
+	default:
+		var j []byte
+		j, err = json.MarshalIndent(g, "", "  ")
+		b.Write(append(j, '\n'))
+	}
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(path.Dir(fn), 0700)
+	return ioutil.WriteFile(fn, b.Bytes(), 0600)
+}
+
+// Selected returns the profile asked for with --profile, GOTOOLS_PROFILE
+// or "current" in that order.
+func (p *Profiles) Selected() string {
+	if name := argValue("profile"); name != "" {
+		return name
+	}
+	if name := os.Getenv("GOTOOLS_PROFILE"); name != "" {
+		return name
+	}
+	if p.Current != "" {
+		return p.Current
+	}
+	return DefaultProfile
+}
+
+func (p *Profiles) Names() (names []string) {
+	for n := range p.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Section returns the settings of a tool in the named profile, merged
+// with the ones it inherits.
+func (p *Profiles) Section(profile, tool string) (map[string]interface{}, error) {
+	chain := []string{}
+	for n := profile; n != ""; {
+		for _, c := range chain {
+			if c == n {
+				return nil, fmt.Errorf("profile %s inherits from itself", n)
+			}
+		}
+		pr, ok := p.Profiles[n]
+		if !ok {
+			if n == DefaultProfile {
+				break
+			}
+			return nil, fmt.Errorf("no profile %s in %s", n, ProfilesPath())
+		}
+		chain = append(chain, n)
+		n, _ = pr["inherits"].(string)
+		if n == "" && chain[len(chain)-1] != DefaultProfile {
+			n = DefaultProfile
+		}
+	}
+
+	m := map[string]interface{}{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if s, ok := p.Profiles[chain[i]][tool].(map[string]interface{}); ok {
+			merge(m, s)
+		}
+	}
+	return m, nil
+}
+
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		d, ok := dst[k].(map[string]interface{})
+		s, ok2 := v.(map[string]interface{})
+		if ok && ok2 {
+			merge(d, s)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// argValue digs a flag value out of the command line ahead of
+// flag.Parse, the profile has to be known before the flags are parsed.
+func argValue(name string) string {
+	args := os.Args[1:]
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		a = strings.TrimLeft(a, "-")
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(a, name+"=") {
+			return strings.TrimPrefix(a, name+"=")
+		}
+	}
+	return ""
+}
+
+func LoadProfileFlags(a interface{}, tool string) {
+	p, err := LoadProfiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := p.Selected()
+	s, err := p.Section(name, tool)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(s) == 0 {
+		return
+	}
+	if err := loadMap(a, s, fmt.Sprintf("%s [%s]", ProfilesPath(), name), nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// maskSecrets masks the secret values of a section, the keys of nested
+// sections are dotted like the flag names.
+func maskSecrets(m map[string]interface{}, prefix string) {
+	for k, v := range m {
+		if sub, ok := v.(map[string]interface{}); ok {
+			maskSecrets(sub, prefix+k+".")
+		} else if secrets[prefix+k] && v != "" {
+			m[k] = mask(fmt.Sprint(v))
+		}
+	}
+}
+
+// ProfileCmd implements "<tool> profile list|show [NAME]|use NAME".
+func ProfileCmd(tool string, args []string) {
+	p, err := LoadProfiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := "list"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "list":
+		sel := p.Selected()
+		for _, n := range p.Names() {
+			mark := " "
+			if n == sel {
+				mark = "*"
+			}
+			fmt.Printf("%s %s\n", mark, n)
+		}
+	case "show":
+		name := p.Selected()
+		if len(args) > 1 {
+			name = args[1]
+		}
+		s, err := p.Section(name, tool)
+		if err != nil {
+			log.Fatal(err)
+		}
+		maskSecrets(s, "")
+		Dump(name+"/"+tool, s)
+	case "use":
+		if len(args) < 2 {
+			log.Fatalf("usage: profile use NAME")
+		}
+		if _, ok := p.Profiles[args[1]]; !ok && args[1] != DefaultProfile {
+			log.Fatalf("no profile %s in %s", args[1], ProfilesPath())
+		}
+		p.Current = args[1]
+		if err := p.Save(); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("usage: profile list|show [NAME]|use NAME")
+	}
+}
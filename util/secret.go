@@ -0,0 +1,248 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretStore keeps the values of the fields tagged secret:"true" out of
+// the plain text config files. The backend is picked with the
+// gotools.secrets git config key or GOTOOLS_SECRETS: "credential" (the
+// default) goes through the configured git credential helper, "file"
+// keeps an encrypted ~/.gotools-secrets, "none" disables the store.
+type SecretStore interface {
+	Get(tool, name string) (string, error)
+	Set(tool, name, val string) error
+}
+
+func Secrets() SecretStore {
+	kind := os.Getenv("GOTOOLS_SECRETS")
+	if kind == "" {
+		kind, _ = Run(context.Background(), `git`, `config`, `gotools.secrets`)
+	}
+	switch kind {
+	case "", "credential":
+		return &credStore{}
+	case "file":
+		return &fileStore{}
+	}
+	return nil
+}
+
+type credStore struct{}
+
+func credInput(tool, name, val string) string {
+	s := fmt.Sprintf("protocol=gotools\nhost=%s\nusername=%s\n", tool, name)
+	if val != "" {
+		s += "password=" + val + "\n"
+	}
+	return s + "\n"
+}
+
+func (c *credStore) git(op, input string) (string, error) {
+	return Exec.Run(context.Background(), &Cmd{
+		Name:  `git`,
+		Args:  []string{`credential`, op},
+		Env:   []string{"GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=true"},
+		Stdin: strings.NewReader(input),
+	})
+}
+
+func (c *credStore) Get(tool, name string) (string, error) {
+	out, err := c.git("fill", credInput(tool, name, ""))
+	if err != nil {
+		return "", err
+	}
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "password=") {
+			return strings.TrimPrefix(s.Text(), "password="), nil
+		}
+	}
+	return "", nil
+}
+
+func (c *credStore) Set(tool, name, val string) error {
+	_, err := c.git("approve", credInput(tool, name, val))
+	return err
+}
+
+type fileStore struct {
+	key  []byte
+	salt []byte
+}
+
+type sealed struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func (f *fileStore) path() string {
+	u, err := user.Current()
+	if err != nil {
+		log.Panic(err)
+	}
+	return path.Join(u.HomeDir, ".gotools-secrets")
+}
+
+func passphrase() ([]byte, error) {
+	if p, ok := os.LookupEnv("GOTOOLS_PASSPHRASE"); ok {
+		return []byte(p), nil
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, fmt.Errorf("GOTOOLS_PASSPHRASE is not set and there is no terminal")
+	}
+	defer tty.Close()
+
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		cmd.Run()
+	}
+	fmt.Fprintf(os.Stderr, "secrets passphrase: ")
+	stty("-echo")
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	stty("echo")
+	fmt.Fprintf(os.Stderr, "\n")
+	return []byte(strings.TrimRight(line, "\r\n")), err
+}
+
+func (f *fileStore) aead(salt []byte) (cipher.AEAD, error) {
+	if f.key == nil || !bytes.Equal(f.salt, salt) {
+		p, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		f.key, err = scrypt.Key(p, salt, 1<<15, 8, 1, 32)
+		if err != nil {
+			return nil, err
+		}
+		f.salt = salt
+	}
+	b, err := aes.NewCipher(f.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func (f *fileStore) load() (map[string]string, []byte, error) {
+	m := map[string]string{}
+	b, err := ioutil.ReadFile(f.path())
+	if os.IsNotExist(err) {
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		return m, salt, err
+	} else if err != nil {
+		return nil, nil, err
+	}
+	s := sealed{}
+	if err = json.Unmarshal(b, &s); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", f.path(), err)
+	}
+	gcm, err := f.aead(s.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := gcm.Open(nil, s.Nonce, s.Data, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: wrong passphrase or corrupted file", f.path())
+	}
+	err = json.Unmarshal(plain, &m)
+	return m, s.Salt, err
+}
+
+func (f *fileStore) Get(tool, name string) (string, error) {
+	if _, err := os.Stat(f.path()); err != nil {
+		return "", nil
+	}
+	m, _, err := f.load()
+	if err != nil {
+		return "", err
+	}
+	return m[tool+"."+name], nil
+}
+
+func (f *fileStore) Set(tool, name, val string) error {
+	m, salt, err := f.load()
+	if err != nil {
+		return err
+	}
+	m[tool+"."+name] = val
+
+	gcm, err := f.aead(salt)
+	if err != nil {
+		return err
+	}
+	s := sealed{Salt: salt, Nonce: make([]byte, gcm.NonceSize())}
+	if _, err = rand.Read(s.Nonce); err != nil {
+		return err
+	}
+	plain, _ := json.Marshal(m)
+	s.Data = gcm.Seal(nil, s.Nonce, plain, nil)
+	b, _ := json.Marshal(&s)
+	return ioutil.WriteFile(f.path(), b, 0600)
+}
+
+// LoadSecretFlags fills the secret flags still empty after the file and
+// git config layers from the secret store.
+func LoadSecretFlags(s string) {
+	store := Secrets()
+	if store == nil {
+		return
+	}
+	for name := range secrets {
+		f := flag.Lookup(name)
+		if f == nil || f.Value.String() != "" {
+			continue
+		}
+		val, err := store.Get(s, name)
+		if err != nil {
+			log.Printf("secret %s.%s: %s", s, name, err)
+			continue
+		}
+		if val == "" {
+			continue
+		}
+		flag.Set(name, val)
+		setOrigin(name, FromSecret, s+"."+name)
+	}
+}
+
+// SaveSecretFlags moves the non-empty secret flag values into the secret
+// store.
+func SaveSecretFlags(s string) error {
+	store := Secrets()
+	if store == nil {
+		return fmt.Errorf("no secret store configured")
+	}
+	for name := range secrets {
+		f := flag.Lookup(name)
+		if f == nil || f.Value.String() == "" {
+			continue
+		}
+		if err := store.Set(s, name, f.Value.String()); err != nil {
+			return err
+		}
+		log.Printf("saved secret: %s.%s", s, name)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Interruptible returns a context cancelled on SIGINT or, when timeout is
+// set, once it expires. A second SIGINT kills the process as usual.
+func Interruptible(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
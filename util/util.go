@@ -1,19 +1,160 @@
 package util
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"os/user"
 	"path"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 )
 
+// FindConfig returns the first of fn, fn.json, fn.yaml, fn.yml and fn.toml
+// that exists.
+func FindConfig(fn string) string {
+	for _, ext := range ConfigExts {
+		if st, err := os.Stat(fn + ext); err == nil && !st.IsDir() {
+			return fn + ext
+		}
+	}
+	return ""
+}
+
+// LoadConfigFile fills a from a JSON, YAML or TOML file. Decoding errors
+// are fatal, keys not matching a field of a only get a warning.
+func LoadConfigFile(a interface{}, fn string) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := DecodeConfig(fn, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = loadMap(a, m, fn, KeyPositions(fn, b)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadMap sets the flags named by the keys of m, nested maps give the
+// dotted names, through their flag.Value like the other layers do, so that
+// "30s" is a duration. Keys without a flag are decoded as JSON into a. The
+// errors are located with pos, the line:column of the keys, when known.
+func loadMap(a interface{}, m map[string]interface{}, where string, pos map[string]string) error {
+	for _, k := range UnknownKeys(m, structValue(a).Type()) {
+		log.Printf("warning: %s: unknown key %s, ignored", where, k)
+	}
+	rest := map[string]interface{}{}
+	if err := setFlags(m, "", where, pos, rest); err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(rest)
+	if err := json.Unmarshal(b, a); err != nil {
+		var terr *json.UnmarshalTypeError
+		if errors.As(err, &terr) {
+			return keyError(where, pos, terr.Field, err)
+		}
+		return fmt.Errorf("%s: %s", where, err)
+	}
+	return nil
+}
+
+// keyError is err in the value of key, at its position when known.
+func keyError(where string, pos map[string]string, key string, err error) error {
+	if p, ok := pos[key]; ok {
+		return fmt.Errorf("%s:%s: %s: %s", where, p, key, err)
+	}
+	return fmt.Errorf("%s: %s: %s", where, key, err)
+}
+
+// lookupFlag finds the flag of a field of the tool's arguments by name,
+// ignoring the case like encoding/json. The common flags, like --output or
+// --dry-run, are not set from files shared by the tools.
+func lookupFlag(name string) (f *flag.Flag) {
+	flag.VisitAll(func(x *flag.Flag) {
+		if fieldFlags[x.Name] && (x.Name == name ||
+			f == nil && strings.EqualFold(x.Name, name)) {
+			f = x
+		}
+	})
+	return
+}
+
+func setFlags(m map[string]interface{}, prefix, where string, pos map[string]string,
+	rest map[string]interface{}) error {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := m[k]
+		f := lookupFlag(prefix + k)
+		if f == nil {
+			sub, ok := v.(map[string]interface{})
+			if !ok {
+				rest[k] = v
+				continue
+			}
+			r := map[string]interface{}{}
+			if err := setFlags(sub, prefix+k+".", where, pos, r); err != nil {
+				return err
+			}
+			if len(r) > 0 {
+				rest[k] = r
+			}
+			continue
+		}
+		for _, s := range flagValues(v) {
+			if err := f.Value.Set(s); err != nil {
+				return keyError(where, pos, prefix+k, fmt.Errorf("%q: %s", s, err))
+			}
+		}
+		setOrigin(f.Name, FromFile, where)
+	}
+	return nil
+}
+
+// flagValues turns a decoded value into the strings to Set, one per item
+// of a list and key=value per entry of a map.
+func flagValues(v interface{}) (r []string) {
+	switch v := v.(type) {
+	case nil:
+	case string:
+		r = append(r, v)
+	case float64:
+		r = append(r, strconv.FormatFloat(v, 'f', -1, 64))
+	case []interface{}:
+		for _, x := range v {
+			r = append(r, flagValues(x)...)
+		}
+	case map[string]interface{}:
+		for k, x := range v {
+			for _, s := range flagValues(x) {
+				r = append(r, k+"="+s)
+			}
+		}
+		sort.Strings(r)
+	default:
+		r = append(r, fmt.Sprint(v))
+	}
+	return
+}
+
+// LoadJsonFlags loads ~/<fn>, despite the name it may be YAML or TOML too.
 func LoadJsonFlags(a interface{}, fn string) {
 	user, err := user.Current()
 	if err != nil {
@@ -24,17 +165,17 @@ func LoadJsonFlags(a interface{}, fn string) {
 	f := flag.Lookup("user")
 	if f != nil {
 		flag.Set("user", user.Username)
+		setOrigin("user", FromDefault, "current user")
 	}
 
-	if f, err := os.Open(path); err == nil {
-		defer f.Close()
-		p := json.NewDecoder(f)
-		p.Decode(a)
+	if path = FindConfig(path); path != "" {
+		LoadConfigFile(a, path)
 	}
 }
 
 func LoadGitFlags(s string) {
-	git := map[string]string{}
+	// multi-valued keys, like several pr.hosts, set the flag once each
+	git := map[string][]string{}
 
 	user, err := user.Current()
 	if err != nil {
@@ -46,87 +187,301 @@ func LoadGitFlags(s string) {
 		path.Join(user.HomeDir, `.gitcred`),
 	}
 	for _, fn := range path {
+		if _, err := os.Stat(fn); err != nil {
+			continue
+		}
 		config := Sh(`git`, `config`, `-l`, `-f`, fn)
 		for _, line := range strings.Split(config, "\n") {
 			parts := strings.SplitN(line, `=`, 2)
-			git[parts[0]] = parts[1]
+			if len(parts) == 2 {
+				git[parts[0]] = append(git[parts[0]], parts[1])
+			}
 		}
 	}
 
 	f := func(f *flag.Flag) {
 		key := s + `.` + strings.Replace(f.Name, "_", "-", -1)
-		if val, ok := git[key]; ok {
-			flag.Set(f.Name, val)
-			f.DefValue = val
+		if vals, ok := git[key]; ok {
+			for _, val := range vals {
+				flag.Set(f.Name, val)
+			}
+			f.DefValue = f.Value.String()
+			setOrigin(f.Name, FromGit, key)
 		}
 	}
 	flag.VisitAll(f)
 }
 
+// SaveGitFlags saves the flags given on the command line to the global git
+// config, the values from the other layers are already kept somewhere.
+// Secrets go to the secret store and are removed from the git config.
 func SaveGitFlags(s string) {
 	git := map[string]string{}
-	config := Sh(`git`, `config`, `-l`)
+	config := Sh(`git`, `config`, `--global`, `-l`)
 	for _, line := range strings.Split(config, "\n") {
 		parts := strings.SplitN(line, `=`, 2)
-		git[parts[0]] = parts[1]
+		if len(parts) == 2 {
+			git[parts[0]] = parts[1]
+		}
 	}
 
 	f := func(f *flag.Flag) {
-		log.Printf("set flag: %s %s", f.Name, f.Value.String())
-		Sh(`git`, `config`, `--global`,
-			s+`.`+strings.Replace(f.Name, "_", "-", -1), f.Value.String())
+		key := s + `.` + strings.Replace(f.Name, "_", "-", -1)
+		if secrets[f.Name] {
+			if _, ok := git[key]; ok {
+				if !DryRun {
+					log.Printf("unset plain text secret: %s", key)
+				}
+				if err := GitConfig(`--unset`, key); err != nil {
+					log.Fatal(err)
+				}
+			}
+			return
+		}
+		if origins[f.Name].Layer != FromFlag {
+			return
+		}
+		if !DryRun {
+			log.Printf("set flag: %s %s", f.Name, f.Value.String())
+		}
+		// one value per item, as LoadGitFlags reads them back
+		if x, ok := f.Value.(*value); ok && x.items() != nil {
+			if _, ok := git[key]; ok {
+				if err := GitConfig(`--unset-all`, key); err != nil {
+					log.Fatal(err)
+				}
+			}
+			for _, v := range x.items() {
+				if err := GitConfig(`--add`, key, v); err != nil {
+					log.Fatal(err)
+				}
+			}
+			return
+		}
+		if err := GitConfig(key, f.Value.String()); err != nil {
+			log.Fatal(err)
+		}
 	}
 	flag.Visit(f)
+
+	err := Mutatef(func() error { return SaveSecretFlags(s) },
+		"save the %s secrets to the secret store", s)
+	if err != nil {
+		log.Printf("secrets not saved: %s", err)
+	}
 }
 
-func ParseFlags(a interface{}) {
-	v := reflect.ValueOf(a).Elem().Elem().Elem()
+// GitConfig runs git config --global with arg, a step of the plan in
+// dry-run mode.
+func GitConfig(arg ...string) error {
+	arg = append([]string{`config`, `--global`}, arg...)
+	return Mutatef(func() error {
+		_, err := Run(context.Background(), `git`, arg...)
+		return err
+	}, "git %s", strings.Join(arg, " "))
+}
+
+func structValue(a interface{}) reflect.Value {
+	v := reflect.ValueOf(a)
 	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
 		v = v.Elem()
 	}
+	return v
+}
+
+// ParseFlags registers a flag for every exported field of the struct a
+// points to. Nested structs become dotted flags (--jenkins.token), slices
+// and maps are repeatable (--label a --label b, --env k=v). The help tag
+// is used as the usage text along with the validation rules.
+func ParseFlags(a interface{}) {
+	parseFlags(structValue(a), "")
+}
+
+func parseFlags(v reflect.Value, prefix string) {
 	t := v.Type()
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
 		name := f.Name
 		tag := f.Tag.Get("json")
-		if tag != "" {
-			name = strings.Split(tag, ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if n := strings.Split(tag, ",")[0]; n != "" {
+			name = n
 		}
 		vf := v.Field(i)
-		switch vf.Type().Kind() {
-		case reflect.Bool:
-			p := (*bool)(unsafe.Pointer(vf.UnsafeAddr()))
-			flag.BoolVar(p, name, *p, "")
-		case reflect.Int:
-			p := (*int)(unsafe.Pointer(vf.UnsafeAddr()))
-			flag.IntVar(p, name, *p, "")
-		case reflect.String:
-			p := (*string)(unsafe.Pointer(vf.UnsafeAddr()))
-			flag.StringVar(p, name, *p, "")
+		if vf.Kind() == reflect.Struct {
+			if f.Anonymous {
+				parseFlags(vf, prefix)
+			} else {
+				parseFlags(vf, prefix+name+".")
+			}
+			continue
 		}
+		name = prefix + name
 
+		if !addFlag(vf, name, usage(f.Tag)) {
+			continue
+		}
+		setOrigin(name, FromDefault, "")
+		fieldFlags[name] = true
+		if f.Tag.Get("secret") == "true" {
+			secrets[name] = true
+		}
 	}
 }
 
-func GetFlags(a interface{}, name string) {
-	ParseFlags(&a)
-	LoadJsonFlags(&a, "."+name)
+func addFlag(vf reflect.Value, name, usage string) bool {
+	p := unsafe.Pointer(vf.UnsafeAddr())
+	if vf.Type() == durationType {
+		flag.DurationVar((*time.Duration)(p), name, *(*time.Duration)(p), usage)
+		return true
+	}
+	switch vf.Kind() {
+	case reflect.Bool:
+		flag.BoolVar((*bool)(p), name, *(*bool)(p), usage)
+	case reflect.Int:
+		flag.IntVar((*int)(p), name, *(*int)(p), usage)
+	case reflect.Int64:
+		flag.Int64Var((*int64)(p), name, *(*int64)(p), usage)
+	case reflect.Uint:
+		flag.UintVar((*uint)(p), name, *(*uint)(p), usage)
+	case reflect.Uint64:
+		flag.Uint64Var((*uint64)(p), name, *(*uint64)(p), usage)
+	case reflect.Float64:
+		flag.Float64Var((*float64)(p), name, *(*float64)(p), usage)
+	case reflect.String:
+		flag.StringVar((*string)(p), name, *(*string)(p), usage)
+	case reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Float32:
+		flag.Var(&value{v: vf}, name, usage)
+	case reflect.Slice:
+		if !scalar(vf.Type().Elem()) {
+			return false
+		}
+		x := &value{v: vf}
+		layered = append(layered, x)
+		flag.Var(x, name, strings.TrimSpace(usage+" (repeatable)"))
+	case reflect.Map:
+		if !scalar(vf.Type().Key()) || !scalar(vf.Type().Elem()) {
+			return false
+		}
+		x := &value{v: vf}
+		layered = append(layered, x)
+		flag.Var(x, name, strings.TrimSpace(usage+" (key=value, repeatable)"))
+	default:
+		return false
+	}
+	return true
+}
+
+// LoadFlags registers the flags for a and fills it from, in increasing
+// order of precedence, its current field values, ~/.<name>, the <name>
+// section of the selected profile, the <name>.* git config keys, the
+// secret store and <NAME>_* environment variables.
+func LoadFlags(a interface{}, name string) {
+	loadFlags(a, name, true)
+}
+
+// LoadFlagsWithoutSecrets is LoadFlags without the secret store, which may
+// prompt for a passphrase or run a credential helper, for shell completion.
+func LoadFlagsWithoutSecrets(a interface{}, name string) {
+	loadFlags(a, name, false)
+}
+
+func loadFlags(a interface{}, name string, withSecrets bool) {
+	flag.String("profile", "", "configuration profile from "+ProfilesPath())
+	flag.StringVar(&Output, "output", Output,
+		"result format: "+strings.Join(Formats, ", "))
+	flag.BoolVar(&DryRun, "dry-run", false,
+		"print the changes that would be made instead of making them")
+	ParseFlags(a)
+	nextLayer()
+	LoadJsonFlags(a, "."+name)
+	nextLayer()
+	LoadProfileFlags(a, name)
+	nextLayer()
 	LoadGitFlags(name)
-	flag.Parse()
+	nextLayer()
+	if withSecrets {
+		LoadSecretFlags(name)
+		nextLayer()
+	}
+	LoadEnvFlags(name)
+	nextLayer()
+}
+
+// SetupCommands only save the configuration, GetFlags doesn't validate the
+// arguments for them.
+var SetupCommands = []string{"install"}
+
+// GetFlags is LoadFlags followed by the command line, which also handles
+// the options and commands common to all the tools.
+func GetFlags(a interface{}, name string) {
+	show := flag.Bool("show-config", false,
+		"print the effective configuration and where each value came from")
+	save := flag.Bool("save-secrets", false,
+		"move the secret values into the secret store and exit")
+	LoadFlags(a, name)
+	parseInterspersed()
+	for _, n := range cmdlineFlags() {
+		if _, ok := origins[n]; ok {
+			setOrigin(n, FromFlag, "--"+n)
+		}
+	}
+	if flag.Arg(0) == "profile" {
+		ProfileCmd(name, flag.Args()[1:])
+		os.Exit(0)
+	}
+	if *show {
+		ShowConfig(os.Stdout)
+		os.Exit(0)
+	}
+	if *save {
+		if err := SaveSecretFlags(name); err != nil {
+			log.Fatalf("%s", err)
+		}
+		os.Exit(0)
+	}
+	var errs ValidationError
+	if !oneOf(flag.Arg(0), SetupCommands) {
+		errs, _ = Validate(a).(ValidationError)
+	}
+	if !oneOf(Output, Formats) {
+		errs = append(errs, fmt.Sprintf("--output must be one of %s, not %q",
+			strings.Join(Formats, ", "), Output))
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s\n", errs)
+		os.Exit(2)
+	}
+	for n := range secrets {
+		if Secrets() == nil {
+			break
+		}
+		if o := origins[n]; o.Layer == FromFile || o.Layer == FromGit {
+			log.Printf("warning: %s is kept in plain text (%s), "+
+				"use --save-secrets and remove it from there", n, o)
+		}
+	}
 }
 
+// Sh runs a command and exits on failure, use Run to handle the error.
 func Sh(cmd string, arg ...string) string {
-	out, err := exec.Command(cmd, arg...).Output()
+	out, err := Run(context.Background(), cmd, arg...)
 	if err != nil {
-		log.Panicf("%s %s : %s", cmd, arg, err)
+		log.Fatal(err)
 	}
-	return strings.TrimSpace(string(out))
+	return out
 }
 
 func Dump(prefix string, v interface{}) {
 	b, _ := json.MarshalIndent(v, "", "  ")
 
-	fmt.Printf("%s: %s\n", prefix, b)
+	fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, b)
 }
 
 func Unpack(src, dst interface{}) {
@@ -0,0 +1,177 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Validation is driven by these field tags:
+//
+//	required:"true"          the field must be set
+//	required:"type=a|b"      ... when the type field is a or b
+//	required:"type!=a|b"     ... unless the type field is a or b
+//	oneof:"a b c"            the value, when set, must be one of these
+//	pattern:"^ami-"          the value, when set, must match the regexp
+//	requires:"group user"    when the field is set, so must be these
+//
+// Fields are referred to by their flag names.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return strings.Join(e, "\n")
+}
+
+type field struct {
+	name string
+	tag  reflect.StructTag
+	v    reflect.Value
+}
+
+func fields(v reflect.Value, prefix string) (r []field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name := f.Name
+		if n := strings.Split(tag, ",")[0]; n != "" {
+			name = n
+		}
+		if f.Type.Kind() == reflect.Struct {
+			if f.Anonymous {
+				r = append(r, fields(v.Field(i), prefix)...)
+			} else {
+				r = append(r, fields(v.Field(i), prefix+name+".")...)
+			}
+			continue
+		}
+		r = append(r, field{name: prefix + name, tag: f.Tag, v: v.Field(i)})
+	}
+	return
+}
+
+func str(v reflect.Value) string {
+	return (&value{v: v}).String()
+}
+
+// condition parses "field=a|b" or "field!=a|b" and reports whether it
+// holds.
+func condition(cond string, byName map[string]field) (bool, error) {
+	neg := strings.Contains(cond, "!=")
+	parts := strings.SplitN(strings.Replace(cond, "!=", "=", 1), "=", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("bad condition %q", cond)
+	}
+	f, ok := byName[parts[0]]
+	if !ok {
+		return false, fmt.Errorf("condition %q refers to unknown field", cond)
+	}
+	val := str(f.v)
+	match := false
+	for _, x := range strings.Split(parts[1], "|") {
+		if x == val {
+			match = true
+		}
+	}
+	return match != neg, nil
+}
+
+func describe(cond string) string {
+	if strings.Contains(cond, "!=") {
+		parts := strings.SplitN(cond, "!=", 2)
+		return fmt.Sprintf("unless --%s is %s", parts[0],
+			strings.Replace(parts[1], "|", " or ", -1))
+	}
+	parts := strings.SplitN(cond, "=", 2)
+	return fmt.Sprintf("when --%s is %s", parts[0],
+		strings.Replace(parts[1], "|", " or ", -1))
+}
+
+func oneOf(val string, list []string) bool {
+	for _, x := range list {
+		if x == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks a against its field tags and returns all the problems
+// found as a ValidationError.
+func Validate(a interface{}) error {
+	fs := fields(structValue(a), "")
+	byName := map[string]field{}
+	for _, f := range fs {
+		byName[f.name] = f
+	}
+
+	var errs ValidationError
+	for _, f := range fs {
+		set := !f.v.IsZero()
+
+		if req := f.tag.Get("required"); req != "" && !set {
+			if req == "true" {
+				errs = append(errs, fmt.Sprintf("--%s is required", f.name))
+			} else if ok, err := condition(req, byName); err != nil {
+				errs = append(errs, fmt.Sprintf("--%s: %s", f.name, err))
+			} else if ok {
+				errs = append(errs, fmt.Sprintf("--%s is required %s",
+					f.name, describe(req)))
+			}
+		}
+		if !set {
+			continue
+		}
+
+		val := str(f.v)
+		if oneof := f.tag.Get("oneof"); oneof != "" {
+			if !oneOf(val, strings.Fields(oneof)) {
+				errs = append(errs, fmt.Sprintf("--%s must be one of %s, not %q",
+					f.name, strings.Join(strings.Fields(oneof), ", "), val))
+			}
+		}
+		if pattern := f.tag.Get("pattern"); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("--%s: bad pattern %q: %s",
+					f.name, pattern, err))
+			} else if !re.MatchString(val) {
+				errs = append(errs, fmt.Sprintf("--%s %q does not look right, expected %s",
+					f.name, val, pattern))
+			}
+		}
+		for _, r := range strings.Fields(f.tag.Get("requires")) {
+			o, ok := byName[r]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("--%s requires unknown field %s",
+					f.name, r))
+			} else if o.v.IsZero() {
+				errs = append(errs, fmt.Sprintf("--%s needs --%s to be set too",
+					f.name, r))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// usage adds the validation rules to the help text of a field.
+func usage(tag reflect.StructTag) string {
+	s := []string{tag.Get("help")}
+	if oneof := tag.Get("oneof"); oneof != "" {
+		s = append(s, "one of: "+strings.Join(strings.Fields(oneof), ", "))
+	}
+	if req := tag.Get("required"); req == "true" {
+		s = append(s, "(required)")
+	} else if req != "" {
+		s = append(s, "(required "+describe(req)+")")
+	}
+	return strings.TrimSpace(strings.Join(s, " "))
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// value is a flag.Value for the field kinds the flag package has no
+// helper for. Slices and maps start over on the first Set of every
+// configuration layer so that, say, --label on the command line replaces
+// the labels from the config file instead of adding to them.
+type value struct {
+	v   reflect.Value
+	set bool
+}
+
+var layered []*value
+
+func nextLayer() {
+	for _, x := range layered {
+		x.set = false
+	}
+}
+
+func scalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func setScalar(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == durationType {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			break
+		}
+		i, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (x *value) String() string {
+	if x == nil || !x.v.IsValid() {
+		return ""
+	}
+	if s := x.items(); s != nil {
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(x.v.Interface())
+}
+
+// items are the values a slice or map is set from one by one, nil for the
+// other kinds.
+func (x *value) items() []string {
+	s := []string{}
+	switch x.v.Kind() {
+	case reflect.Slice:
+		for i := 0; i < x.v.Len(); i++ {
+			s = append(s, fmt.Sprint(x.v.Index(i).Interface()))
+		}
+	case reflect.Map:
+		for _, k := range x.v.MapKeys() {
+			s = append(s, fmt.Sprintf("%v=%v", k.Interface(),
+				x.v.MapIndex(k).Interface()))
+		}
+		sort.Strings(s)
+	default:
+		return nil
+	}
+	return s
+}
+
+func (x *value) Set(s string) error {
+	switch x.v.Kind() {
+	case reflect.Slice:
+		if !x.set {
+			x.v.Set(reflect.MakeSlice(x.v.Type(), 0, 1))
+			x.set = true
+		}
+		e := reflect.New(x.v.Type().Elem()).Elem()
+		if err := setScalar(e, s); err != nil {
+			return err
+		}
+		x.v.Set(reflect.Append(x.v, e))
+	case reflect.Map:
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected key=value, got %q", s)
+		}
+		if !x.set {
+			x.v.Set(reflect.MakeMap(x.v.Type()))
+			x.set = true
+		}
+		k := reflect.New(x.v.Type().Key()).Elem()
+		if err := setScalar(k, kv[0]); err != nil {
+			return err
+		}
+		e := reflect.New(x.v.Type().Elem()).Elem()
+		if err := setScalar(e, kv[1]); err != nil {
+			return err
+		}
+		x.v.SetMapIndex(k, e)
+	default:
+		return setScalar(x.v, s)
+	}
+	return nil
+}
+
+func (x *value) IsBoolFlag() bool {
+	return x.v.IsValid() && x.v.Kind() == reflect.Bool
+}